@@ -9,7 +9,9 @@ import (
 // NegtServer 对外接口
 type NegtServer interface {
 	Ping(ctx context.Context) error
+	Health(ctx context.Context) *dao.HealthRet
 	Query(ctx context.Context) *dao.QueryRet
+	Cmd(ctx context.Context, name string, args map[string]string) *dao.CmdRet
 	Port() int
 	Timeout() time.Duration
 }
@@ -5,16 +5,44 @@ import (
 	"github.com/go-yaml/yaml"
 	"io/ioutil"
 	"log"
+	"sync"
 	"time"
 )
 
 type (
 	PgConfig struct {
-		DefaultDSN   string        `yaml:"DefaultDSN"`   // postgres default database connect dsn
+		DefaultDSN   string        `yaml:"DefaultDSN"`   // postgres default database connect dsn (it or its password can be a secret reference dapr:/env:/file:
 		QueryTimeout time.Duration `yaml:"QueryTimeout"` // time out of pg query (dimension:millisecond
 		MaxIdleConns int           `yaml:"MaxIdleConns"` // max number of idles existed
 		MaxOpenConns int           `yaml:"MaxOpenConns"` // max number of idles opened
 		LogLevel     string        `yaml:"LogLevel"`     // log level of pg connection
+		PingTimeout  time.Duration `yaml:"PingTimeout"`  // time out of pinging each pg connection in health check (dimension:millisecond
+		// sql slower than this is logged at warn level (dimension:millisecond, 0 for 200, negative for never
+		SlowThreshold time.Duration `yaml:"SlowThreshold"`
+		// max lifetime of a pg connection (dimension:second, 0 for unlimited
+		ConnMaxLifetime time.Duration `yaml:"ConnMaxLifetime"`
+		// application_name of task connections shown in pg_stat_activity, can be overridden in TaskConns
+		ApplicationName string `yaml:"ApplicationName"`
+		// interval of checking idle pg pools, failed ones are closed and reconnected when used (dimension:second, 0 for never
+		PoolCheckInterval time.Duration `yaml:"PoolCheckInterval"`
+		// pools of task databases unused for longer than this are closed (dimension:second, 0 for never
+		PoolIdleTimeout time.Duration `yaml:"PoolIdleTimeout"`
+		// connection settings of each task, keyed by task name
+		TaskConns map[string]TaskConnConfig `yaml:"TaskConns"`
+		// order query results in sql instead of sorting them in memory (procedures are always sorted in memory
+		OrderInSQL bool `yaml:"OrderInSQL"`
+	}
+	TaskConnConfig struct {
+		MaxIdleConns    int           `yaml:"MaxIdleConns"`    // max number of idles existed (0 for DbCfg.MaxIdleConns
+		MaxOpenConns    int           `yaml:"MaxOpenConns"`    // max number of idles opened (0 for DbCfg.MaxOpenConns
+		ConnMaxLifetime time.Duration `yaml:"ConnMaxLifetime"` // max lifetime of a connection (dimension:second, 0 for DbCfg.ConnMaxLifetime
+		SSLMode         string        `yaml:"SSLMode"`         // disable/allow/prefer/require/verify-ca/verify-full
+		SSLRootCert     string        `yaml:"SSLRootCert"`     // path of root certificate file
+		SSLCert         string        `yaml:"SSLCert"`         // path of client certificate file
+		SSLKey          string        `yaml:"SSLKey"`          // path of client private key file
+		ApplicationName string        `yaml:"ApplicationName"` // application_name (empty for DbCfg.ApplicationName
+		ConnectTimeout  int           `yaml:"ConnectTimeout"`  // time out of connecting (dimension:second, 0 for no time out
+		SearchPath      string        `yaml:"SearchPath"`      // search_path of the connection
 	}
 	CfgTableConfig struct {
 		SchemaName string `yaml:"SchemaName"` // name of the schema in which all finance message tables are
@@ -22,18 +50,29 @@ type (
 		FinInfo    string `yaml:"FinInfo"`    // name of the table which stores every finance file`s message
 		FieldInfo  string `yaml:"FieldInfo"`  // name of the table which stores every finance field`s message
 		Fin2Table  string `yaml:"Fin2Table"`  // name of the table which stores corresponding tables for all finance files
-
+		// interval of reloading all the tables above into memory (dimension:second, 0 for never
+		RefreshInterval time.Duration `yaml:"RefreshInterval"`
 	}
 	ServiceConfig struct {
 		HttpPort        int           `yaml:"HttpPort"`        // http port
 		Timeout         time.Duration `yaml:"Timeout"`         // http query time out(dimension:second
 		SubscribeServer []string      `yaml:"SubscribeServer"` // servers which subscribe this server     host:port
+		// token required by /cmd in header "Authorization: Bearer <token>", can be a secret reference (empty for /cmd disabled
+		CmdToken string `yaml:"CmdToken"`
 	}
 
 	SettingConfig struct {
-		RowLimit    int    `yaml:"RowLimit"`    // limit of row numbers in a process
-		LogPath     string `yaml:"LogPath"`     // log file path
-		StatLogPath string `yaml:"StatLogPath"` // status log file path
+		RowLimit    int    `yaml:"RowLimit"`    // limit of row numbers in a response, pages beyond it are fetched by cursor (<=0 for no limit
+		LogPath     string `yaml:"LogPath"`     // log file path (empty for stderr
+		StatLogPath string `yaml:"StatLogPath"` // status log file path, one line per request and finance file (empty for no status log
+		ExportPath  string `yaml:"ExportPath"`  // directory of parquet files written by cron export tasks (empty for no files
+		LogLevel    string `yaml:"LogLevel"`    // level of service log: debug/info/warn/error
+		// max size of a log file before rotated (dimension:MB, 0 for rotating by day only
+		LogMaxSize int `yaml:"LogMaxSize"`
+		// number of rotated log files kept (0 for keeping all
+		LogMaxBackups int `yaml:"LogMaxBackups"`
+		// file which finished trace spans are appended to, one json per line (empty for no export
+		TracePath string `yaml:"TracePath"`
 	}
 
 	Config struct {
@@ -47,12 +86,17 @@ type (
 var (
 	cfgFile   *string
 	configure Config
+	cfgOnce   sync.Once
 )
 
 /*GetConfigure
- * @Description: 获取配置
+ * @Description: 获取配置，仅在第一次调用时读取配置文件
  */
 func GetConfigure() {
+	cfgOnce.Do(loadConfigure)
+}
+
+func loadConfigure() {
 	// 注释中为线上环境配置
 	//cfgFile = flag.String("f", "/usr/local/conf/conf.yaml", "config file path")
 	cfgFile = flag.String("f", "/Users/heqimin/Code/Go/finance/pg-adapter/conf/conf.yaml", "config file path")
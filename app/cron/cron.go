@@ -1,8 +1,8 @@
 package cron
 
 import (
-	"fmt"
 	"github.com/robfig/cron/v3"
+	"pg-adapter/app/logger"
 )
 
 func init() {
@@ -11,9 +11,9 @@ func init() {
 	spec := "*/1 * * * * ?" //cron表达式
 	_, err := crontab.AddFunc(spec, exportCron)
 	if err != nil {
-		fmt.Println(err.Error())
+		logger.Error("make cron task failed", "error", err)
 	} else {
-		fmt.Println("make cron task successfully!")
+		logger.Info("make cron task successfully")
 	}
 	crontab.Start()
 }
@@ -1,8 +1,8 @@
 package cron
 
 import (
-	"log"
 	"pg-adapter/app/dao"
+	"pg-adapter/app/logger"
 	"strings"
 	"time"
 )
@@ -11,8 +11,7 @@ func exportCron() {
 	nowTime := time.Now()
 	nowMS := nowTime.Hour()*10000 + nowTime.Minute()*100 + nowTime.Second()
 
-	if _, ok := dao.CronTab[nowMS]; ok {
-		taskNames := dao.CronTab[nowMS]
+	if taskNames, ok := dao.CronTasks(nowMS); ok {
 		go tasksExport(taskNames)
 	}
 }
@@ -24,7 +23,7 @@ func tasksExport(taskNames string) {
 	for _, taskName := range tasks {
 		err := dao.TaskProc(taskName)
 		if err != nil {
-			log.Println(err.Error())
+			logger.Error("task export failed", "task", taskName, "error", err)
 		}
 	}
 }
@@ -0,0 +1,118 @@
+package dao
+
+/*
+author:heqimin
+purpose:时点查询，只返回src-time在指定时刻及之前到达的数据版本，用于还原历史上某一时刻可见的数据
+*/
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// srcTimeLayout src-time的格式，可按字符串比较先后
+const srcTimeLayout = "2006-01-02 15:04:05.000000"
+
+/**
+ * @Description: 解析asof参数并转化为与src-time相同的格式
+ * @Description: 支持 2006-01-02 15:04:05[.000000]、RFC3339（按其中的时刻，不做时区转换）；仅有日期（2006-01-02或20060102）时为当天结束
+ * @param s 为空时不使用时点查询
+ * @return asof
+ * @return err
+ */
+func parseAsof(s string) (asof string, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano} {
+		if t, e := time.Parse(layout, s); e == nil {
+			return t.Format(srcTimeLayout), nil
+		}
+	}
+	for _, layout := range []string{"2006-01-02", "20060102"} {
+		if t, e := time.Parse(layout, s); e == nil {
+			return t.Add(24*time.Hour - time.Microsecond).Format(srcTimeLayout), nil
+		}
+	}
+	return "", fmt.Errorf("error asof param: %q, should be like 2021-08-03 15:04:05", s)
+}
+
+/**
+ * @Description: 判断数据版本在asof时刻是否可见，src-time为空的版本无法确定到达时间，不可见
+ * @param srcTime
+ * @param asof
+ * @return bool
+ */
+func visibleAt(srcTime string, asof string) bool {
+	return srcTime != "" && srcTime <= asof
+}
+
+/**
+ * @Description: 在sql中只保留每个市场代码每个日期最新的一个版本（按rtime）
+ * @param unionSql 各市场的select（已过滤rtime），不含结尾的;
+ * @return string
+ */
+func asofSql(unionSql string) string {
+	return fmt.Sprintf("select distinct on (%[1]s,%[2]s,%[3]s) * from (%[5]s) s order by %[1]s,%[2]s,%[3]s,%[4]s desc",
+		MARKET, ZQDM, BBRQ, RTIME, unionSql)
+}
+
+/**
+ * @Description: 逐行选出每个(market, code, datetime)src-time最新的版本，不缓存结果
+ * @Description: 只与同一键的上一行比较，同一键的数据需在结果中相邻
+ */
+type versionPicker struct {
+	code string
+	dv   DateValue
+	has  bool // 是否有未输出的版本
+	emit func(code string, dv DateValue) error
+}
+
+/**
+ * @Description: 处理一行：键与上一行不同时输出上一个键的最新版本
+ * @receiver p
+ * @param code
+ * @param dv
+ * @return error
+ */
+func (p *versionPicker) add(code string, dv DateValue) error {
+	if p.has && (code != p.code || dv.Market != p.dv.Market || dv.DateTime != p.dv.DateTime) {
+		if err := p.flush(); err != nil {
+			return err
+		}
+	}
+	if !p.has || dv.SrcTime > p.dv.SrcTime {
+		p.code, p.dv, p.has = code, dv, true
+	}
+	return nil
+}
+
+/**
+ * @Description: 输出最后一个键的最新版本
+ * @receiver p
+ * @return error
+ */
+func (p *versionPicker) flush() error {
+	if !p.has {
+		return nil
+	}
+	p.has = false
+	return p.emit(p.code, p.dv)
+}
+
+/**
+ * @Description: 存储过程结果的时点筛选，sql的结果已由asofSql筛选，不经过此处
+ * @Description: 逐行处理，每个(market, code, datetime)只保留asof时可见的最新版本；存储过程需按市场、代码、日期输出，同一键的数据相邻
+ * @receiver cp
+ * @param emit
+ * @return error
+ */
+func (cp *colsProc) asofEach(emit func(code string, dv DateValue) error) error {
+	p := &versionPicker{emit: emit}
+	if err := cp.rowsEach(p.add); err != nil {
+		return err
+	}
+	return p.flush()
+}
@@ -0,0 +1,81 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAsof(t *testing.T) {
+	cases := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"2021-08-03 15:04:05", "2021-08-03 15:04:05.000000", false},
+		{" 2021-08-03 15:04:05.123 ", "2021-08-03 15:04:05.123000", false},
+		{"2021-08-03 15:04:05.1234567", "2021-08-03 15:04:05.123456", false},
+		{"2021-08-03T15:04:05+08:00", "2021-08-03 15:04:05.000000", false},
+		{"2021-08-03", "2021-08-03 23:59:59.999999", false},
+		{"20210803", "2021-08-03 23:59:59.999999", false},
+		{"2021-02-30", "", true},
+		{"2021-08-03 25:00:00", "", true},
+		{"2021-08-03' or '1'='1", "", true},
+		{"yesterday", "", true},
+	}
+	for _, c := range cases {
+		asof, err := parseAsof(c.s)
+		if c.wantErr {
+			assert.NotNil(t, err, c.s)
+			continue
+		}
+		assert.Nil(t, err, c.s)
+		assert.Equal(t, c.want, asof, c.s)
+	}
+}
+
+func TestVisibleAt(t *testing.T) {
+	asof := "2021-08-03 15:00:00.000000"
+	assert.True(t, visibleAt("2021-08-03 15:00:00.000000", asof))
+	assert.True(t, visibleAt("2021-08-02 15:00:00.000000", asof))
+	assert.False(t, visibleAt("2021-08-03 15:00:00.000001", asof))
+	// NULL rtime 为空的src-time，不可见
+	assert.False(t, visibleAt("", asof))
+}
+
+func TestVersionPicker(t *testing.T) {
+	dv := func(market string, datetime int, srcTime string) DateValue {
+		return DateValue{Market: market, DateTime: datetime, SrcTime: srcTime}
+	}
+	var got []string
+	p := &versionPicker{emit: func(code string, dv DateValue) error {
+		got = append(got, dv.Market+":"+code+":"+dv.SrcTime)
+		return nil
+	}}
+	rows := []struct {
+		code string
+		dv   DateValue
+	}{
+		{"600000", dv("17", 20210803, "2021-08-03 09:00:00.000000")},
+		{"600000", dv("17", 20210803, "2021-08-03 11:00:00.000000")},
+		{"600000", dv("17", 20210803, "2021-08-03 10:00:00.000000")},
+		{"600000", dv("17", 20210804, "2021-08-04 09:00:00.000000")},
+		{"300033", dv("33", 20210804, "2021-08-04 09:00:00.000000")},
+		{"300033", dv("17", 20210804, "2021-08-04 10:00:00.000000")},
+	}
+	for _, r := range rows {
+		assert.Nil(t, p.add(r.code, r.dv))
+	}
+	// 最后一个键在flush时输出
+	assert.Len(t, got, 3)
+	assert.Nil(t, p.flush())
+	assert.Equal(t, []string{
+		"17:600000:2021-08-03 11:00:00.000000",
+		"17:600000:2021-08-04 09:00:00.000000",
+		"33:300033:2021-08-04 09:00:00.000000",
+		"17:300033:2021-08-04 10:00:00.000000",
+	}, got)
+	assert.Nil(t, p.flush())
+	assert.Len(t, got, 4)
+}
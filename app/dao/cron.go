@@ -1,22 +1,91 @@
 package dao
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"pg-adapter/app/config"
+	applog "pg-adapter/app/logger"
+	"pg-adapter/app/trace"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type (
-	CronTask map[int]string
+	CronTask map[int]string // 时分秒(hhmmss)=>以逗号隔开的任务名
 )
 
-var (
-	CronTab = make(CronTask) // 用于存储所有任务的定时任务时间
-)
+/*CronTasks
+ * @Description: 获取某一时刻需要执行的定时任务，定时任务随配置缓存刷新
+ * @param hms 时分秒，hhmmss形式的整数
+ * @return taskNames 以逗号隔开的任务名
+ * @return ok 该时刻是否有任务
+ */
+func CronTasks(hms int) (taskNames string, ok bool) {
+	taskNames, ok = getMeta().cron[hms]
+	return
+}
+
+// ErrTaskRunning 任务正在导出，同一任务不并发导出
+var ErrTaskRunning = errors.New("task is already running")
+
+// runningTasks 正在导出的任务名
+var runningTasks sync.Map
 
+/*TaskProc
+ * @Description: 定时导出任务下所有财务文件当天的数据，任务正在导出时返回ErrTaskRunning
+ * @Description: 配置了Setting.ExportPath时每个财务文件写为 ExportPath/任务名/财务文件名_日期.parquet
+ * @param taskName
+ * @return error
+ */
 func TaskProc(taskName string) error {
-	log.Println("start to handle task:", taskName)
+	if _, running := runningTasks.LoadOrStore(taskName, true); running {
+		return fmt.Errorf("task %s: %w", taskName, ErrTaskRunning)
+	}
+	defer runningTasks.Delete(taskName)
+	return taskProc(taskName)
+}
+
+/*StartTaskProc
+ * @Description: 异步执行任务导出，任务正在导出时不执行并返回ErrTaskRunning
+ * @param taskName
+ * @param done 导出结束后以导出结果调用
+ * @return error
+ */
+func StartTaskProc(taskName string, done func(err error)) error {
+	if _, running := runningTasks.LoadOrStore(taskName, true); running {
+		return fmt.Errorf("task %s: %w", taskName, ErrTaskRunning)
+	}
+	go func() {
+		defer runningTasks.Delete(taskName)
+		done(taskProc(taskName))
+	}()
+	return nil
+}
+
+/**
+ * @Description: 导出任务下所有财务文件当天的数据，任意财务文件导出或写文件失败时返回汇总的错误（其余财务文件仍继续导出）
+ * @param taskName
+ * @return error
+ */
+func taskProc(taskName string) (err error) {
+	applog.Info("start to handle task", "task", taskName)
+	begin := time.Now()
+	ctx, span := trace.Root(context.Background(), "TaskProc")
+	span.SetAttr("task", taskName)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		result := resultOk
+		if err != nil {
+			result = resultError
+		}
+		taskTotal.Inc(taskName, result)
+		taskDuration.Observe(time.Since(begin).Seconds(), taskName)
+	}()
 	finNames, err := getFins(taskName)
 	if err != nil {
 		// TODO log
@@ -25,33 +94,53 @@ func TaskProc(taskName string) error {
 	year, month, day := time.Now().Date()
 	//ret := &QueryRet{Data: make([]SchemaValue, 0)}
 	// go里重定义了month类型
+	today := year*10000 + int(month)*100 + day
 	para := exportParam{
 		opRtime,
-		year*10000 + int(month)*100 + day,
-		year*10000 + int(month)*100 + day,
+		today,
+		today,
 		"",
 	}
+	exportPath := config.Setting().ExportPath
+	var failed []string // 导出或写文件失败的财务文件
+	defer func() {
+		if err == nil && len(failed) != 0 {
+			err = fmt.Errorf("%d of %d finance files failed: %s", len(failed), len(finNames), strings.Join(failed, "; "))
+		}
+	}()
 	for _, finName := range finNames {
 		e := &finExport{
 			finName: finName,
 			p:       para,
 		}
-		e.Start()
-		if err != nil {
-			log.Println(err.Error())
+		execHandle(ctx, methodTask, e)
+		if e.Error() != nil {
+			applog.Error("task export failed", "task", taskName, "fin", finName, "error", e.Error())
+			failed = append(failed, fmt.Sprintf("%s: %v", finName, e.Error()))
+			continue
+		}
+		if exportPath == "" {
+			continue
+		}
+		path := filepath.Join(exportPath, taskName, fmt.Sprintf("%s_%d.parquet", finName, today))
+		qr := &QueryRet{Data: []SchemaValue{e.Data()}}
+		if werr := writeParquetFile(path, qr); werr != nil {
+			applog.Error("write parquet failed", "task", taskName, "fin", finName, "path", path, "error", werr)
+			failed = append(failed, fmt.Sprintf("%s: %v", finName, werr))
 		}
 	}
 	return nil
 }
 
 /*AppendCron
- * @Description: 将数据库获得的map
- * @param crons
+ * @Description: 将任务的定时导出时间加入定时任务
+ * @param taskName
+ * @param cron
  */
-func AppendCron(taskName string, cron string) {
+func (ct CronTask) AppendCron(taskName string, cron string) {
 	crons := GetCron(cron)
 	for _, v := range crons {
-		CronTab[v] += taskName + ","
+		ct[v] += taskName + ","
 	}
 }
 
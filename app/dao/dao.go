@@ -2,14 +2,18 @@ package dao
 
 import (
 	"context"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/wire"
+	"github.com/pkg/errors"
 	"gorm.io/gorm"
+	"sort"
 )
 
 const (
 	METHOD = "method"
 	VALUE  = "value"
+	WRITER = "writer" // 流式输出时逐条接收数据的RecordWriter
 )
 
 const (
@@ -23,6 +27,7 @@ var Provider = wire.NewSet(New, NewDB)
 type Dao interface {
 	Close()
 	Ping(ctx context.Context) error
+	Health(ctx context.Context) *HealthRet
 	Query(ctx context.Context) *QueryRet
 }
 
@@ -45,9 +50,9 @@ type dao struct {
 						"src-time": "2021-07-29 08:05:29.945040",
 						"market": "19",
 						"value": {
-							"rqche": "0.00",
-							"rqjmce": "0.00",
-							"rqmce": "0.00"
+							"rqche": 0,
+							"rqjmce": 12.5,
+							"rqmce": null
 						}
 					}
 				]
@@ -56,7 +61,7 @@ type dao struct {
 	}
 */
 type (
-	RowValue map[string]interface{} // 每行所有数据
+	RowValue map[string]interface{} // 每行所有数据，值按字段类型为数字、YYYYMMDD形式的整数日期或字符串，空值为null
 
 	DateValue struct {
 		DateTime int      `json:"datetime"`
@@ -77,9 +82,69 @@ type (
 		Sv  SchemaValue
 	}
 	QueryRet struct {
-		Code int           `json:"status_code"`
-		Msg  string        `json:"status_msg"`
-		Data []SchemaValue `json:"data"`
+		Code   int           `json:"status_code"`
+		Msg    string        `json:"status_msg"`
+		Data   []SchemaValue `json:"data"`
+		Cursor string        `json:"cursor,omitempty"` // 下一页游标，为空说明已无更多数据
+		fields []string      // 数据字段的输出顺序，为空时按字段名排序
+	}
+	// CmdRet 管理命令返回格式
+	CmdRet struct {
+		Code int         `json:"status_code"`
+		Msg  string      `json:"status_msg"`
+		Data interface{} `json:"data"`
+	}
+)
+
+/**
+ * @Description: 流式输出的单条数据，每个代码的每个日期一条
+ * @return 示例如下:
+	{"schema":"sz","code":"159806","datetime":20210727,"src-time":"2021-07-29 08:05:29.945040","market":"19","value":{"rqche":0}}
+*/
+type (
+	Record struct {
+		Schema string `json:"schema"`
+		Code   string `json:"code"`
+		DateValue
+		fin string     // 所属财务文件
+		pos pageCursor // 分页时该数据的位置
+	}
+	// RecordWriter 逐条接收数据，需由调用方保证并发安全以外的写入语义（如连接断开后返回错误
+	RecordWriter interface {
+		WriteRecord(r Record) error
+	}
+)
+
+/**
+ * @Description: query请求的json请求体，与表单参数 datatype/datetime/codelist 等价
+ * @return 示例如下:
+	{
+		"fields": [321, 322],
+		"markets": [
+			{"market": 17, "codes": []},
+			{"market": 33, "codes": ["300033", "300093"]}
+		],
+		"start": 20210803,
+		"end": 20210803,
+		"merge": "latest"
+	}
+*/
+type (
+	MarketCodes struct {
+		Market int      `json:"market"` // 市场号
+		Codes  []string `json:"codes"`  // 代码列表，为空则取该市场下全部代码
+	}
+	QueryBody struct {
+		Fields  []int         `json:"fields"`  // 字段id，即datatype
+		Markets []MarketCodes `json:"markets"` // 市场及代码
+		Start   int           `json:"start"`   // 开始日期，为空则为昨天
+		End     int           `json:"end"`     // 截止日期，为空则为今天
+		Cursor  string        `json:"cursor"`  // 分页游标，取上一页返回的cursor
+		Merge   string        `json:"merge"`   // 多个财务文件按市场、代码、日期合并：latest/earliest，为空不合并
+		// 快照日期，不为0时忽略start/end，每个代码只返回该日期及之前最新的一条
+		Snapshot int `json:"snapshot"`
+		// 时点，例如 2021-08-03 15:04:05，每个代码每个日期只返回src-time在该时刻及之前的最新版本
+		Asof string `json:"asof"`
 	}
 )
 
@@ -89,7 +154,6 @@ func New(db *gorm.DB) (d Dao, cf func(), err error) {
 }
 
 func newDao(db *gorm.DB) (d *dao, cf func(), err error) {
-	err = taskMapInit(db)
 	d = &dao{
 		db,
 	}
@@ -101,8 +165,27 @@ func (d *dao) Close() {
 
 }
 
+/*Ping
+ * @Description: 检查所有pg连接，任意连接不可用时返回错误
+ * @receiver d
+ * @param ctx
+ * @return error
+ */
 func (d *dao) Ping(ctx context.Context) error {
-	return nil
+	h := Health(ctx)
+	if h.Status == StatusUp {
+		return nil
+	}
+	for _, ph := range h.Checks {
+		if ph.Status == StatusDown {
+			return fmt.Errorf("%s: %s", ph.DSN, ph.Error)
+		}
+	}
+	return errors.New("default database is not connected")
+}
+
+func (d *dao) Health(ctx context.Context) *HealthRet {
+	return Health(ctx)
 }
 
 /*Query
@@ -112,29 +195,82 @@ func (d *dao) Ping(ctx context.Context) error {
  * @return error
  */
 func (d *dao) Query(ctx context.Context) *QueryRet {
-	return StartHandle(ctx.Value(VALUE).(map[string]interface{}))
+	return StartHandle(ctx, ctx.Value(VALUE).(map[string]interface{}))
+}
+
+/*Fields
+ * @Description: 获取数据字段的输出顺序（csv等表格输出的列），query请求为datatype的顺序，export请求为字段名排序
+ * @receiver qr
+ * @return []string
+ */
+func (qr *QueryRet) Fields() []string {
+	if qr.fields != nil {
+		return qr.fields
+	}
+	seen := make(map[string]bool)
+	fields := make([]string, 0)
+	for _, sv := range qr.Data {
+		for _, cv := range sv.Codelist {
+			for _, dv := range cv.TimeList {
+				for field := range dv.Value {
+					if !seen[field] {
+						seen[field] = true
+						fields = append(fields, field)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields
 }
 
 /*GetQueryPara
  * @Description: 解析query请求，获取创建导出任务所需的参数
+ * @Description: Content-Type为application/json时解析为*QueryBody，否则按表单解析为map[string]string
  * @param c
  * @return
  * @example
  */
-func GetQueryPara(c *gin.Context) map[string]string {
-	return map[string]string{
-		CODELIST: c.PostForm(CODELIST),
-		DATATYPE: c.PostForm(DATATYPE),
-		DATETIME: c.PostForm(DATETIME),
+func GetQueryPara(c *gin.Context) (interface{}, error) {
+	if c.ContentType() == gin.MIMEJSON {
+		body := new(QueryBody)
+		if err := c.ShouldBindJSON(body); err != nil {
+			return nil, errors.Wrap(err, "error json body")
+		}
+		return body, nil
 	}
+	return map[string]string{
+		CODELIST: FormValue(c, CODELIST),
+		DATATYPE: FormValue(c, DATATYPE),
+		DATETIME: FormValue(c, DATETIME),
+		CURSOR:   FormValue(c, CURSOR),
+		MERGE:    FormValue(c, MERGE),
+		SNAPSHOT: FormValue(c, SNAPSHOT),
+		ASOF:     FormValue(c, ASOF),
+	}, nil
 }
 
 func GetExportPara(c *gin.Context) map[string]string {
 	return map[string]string{
-		FINNAME:   c.PostForm(FINNAME),
-		TYPE:      c.PostForm(TYPE),
-		STARTDATE: c.PostForm(STARTDATE),
-		ENDDATE:   c.PostForm(ENDDATE),
-		CODELIST:  c.PostForm(CODELIST),
+		FINNAME:   FormValue(c, FINNAME),
+		TYPE:      FormValue(c, TYPE),
+		STARTDATE: FormValue(c, STARTDATE),
+		ENDDATE:   FormValue(c, ENDDATE),
+		CODELIST:  FormValue(c, CODELIST),
+		CURSOR:    FormValue(c, CURSOR),
+	}
+}
+
+/*FormValue
+ * @Description: 获取请求参数，优先取表单，表单中没有时取url参数（GET请求不解析请求体）
+ * @param c
+ * @param key
+ * @return string
+ */
+func FormValue(c *gin.Context, key string) string {
+	if v, ok := c.GetPostForm(key); ok {
+		return v
 	}
+	return c.Query(key)
 }
@@ -1,15 +1,25 @@
 package dao
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 var d *dao
 
+// testDBEnv 设置该环境变量时才连接配置文件中的pg，其余测试不依赖数据库
+const testDBEnv = "PG_ADAPTER_TEST_DB"
+
 // TestMain dao层测试主入口
 func TestMain(m *testing.M) {
-	var err error
-	var cf func()
-	if d, cf, err = newTestDao(); err != nil {
-		panic(err)
+	cf := func() {}
+	if os.Getenv(testDBEnv) != "" {
+		var err error
+		if d, cf, err = newTestDao(); err != nil {
+			panic(err)
+		}
 	}
+	code := m.Run()
 	cf()
+	os.Exit(code)
 }
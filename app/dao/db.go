@@ -6,13 +6,13 @@ package dao
 */
 
 import (
-	"fmt"
+	"context"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
-	"log"
 	"pg-adapter/app/config"
+	applog "pg-adapter/app/logger"
 	"strconv"
 	"strings"
 )
@@ -21,9 +21,13 @@ import (
  * @Description: 用于对不同协议的导出实现多态
  */
 type Handle interface {
-	Start()            // 开始导出执行
-	Error() error      // 返回错误
-	Data() SchemaValue // 返回数据
+	Start(context.Context)  // 开始导出执行，ctx取消时中止sql执行
+	Error() error           // 返回错误
+	Data() SchemaValue      // 返回数据
+	setWriter(RecordWriter) // 设置流式输出，设置后数据不再缓存到Data()中
+	fin() string            // 财务文件名
+	rowCount() int          // 读取的行数
+	setPage(pageOpt)        // 设置分页，设置后只读取游标之后的至多limit条
 }
 
 type dbHandle struct {
@@ -40,6 +44,18 @@ type (
 		user   string
 		passwd string
 		dbname string
+		opts   connOptions // 可选连接参数，来自DbCfg.TaskConns
+	}
+
+	// connOptions 可选的pg连接参数，为空的不加入dsn
+	connOptions struct {
+		sslMode         string // disable/allow/prefer/require/verify-ca/verify-full
+		sslRootCert     string // 根证书文件
+		sslCert         string // 客户端证书文件
+		sslKey          string // 客户端私钥文件
+		applicationName string // 在pg_stat_activity中显示的应用名
+		connectTimeout  int    // 建立连接超时，秒
+		searchPath      string // 模式搜索路径
 	}
 
 	// dbConfTables 适配老版财务数据配置表
@@ -53,6 +69,15 @@ type (
 
 	// procSQLs 五种导出sql
 	procSQLs [5]string
+
+	// handleOpt query和export公用的请求参数
+	handleOpt struct {
+		cursor   *pageCursor // 分页游标，为nil时从第一页开始
+		fields   []string    // query请求按datatype顺序排列的字段名，export请求为空
+		method   string      // 请求类型，用于指标标签
+		merge    string      // 多个财务文件的合并策略，为空时不合并，仅query请求
+		snapshot bool        // 快照请求，合并时按(market, code)合并
+	}
 )
 
 /**
@@ -68,6 +93,8 @@ type (
 		marketCodes map[int]string // 代码列表
 		startdate   int            // 开始日期
 		enddate     int            // 截止日期
+		snapshot    int            // 快照日期，不为0时每个代码的每个字段只返回该日期及之前最新的非空值
+		asof        string         // 时点（src-time格式），不为空时只返回该时刻及之前到达的版本
 	}
 
 	finQuery struct {
@@ -75,6 +102,9 @@ type (
 		p    queryPara
 		err  error
 		data SchemaValue
+		w    RecordWriter // 流式输出
+		rows int          // 读取的行数
+		page pageOpt      // 分页参数
 	}
 )
 
@@ -96,16 +126,16 @@ type (
 		p       exportParam
 		err     error
 		data    SchemaValue
+		w       RecordWriter // 流式输出
+		rows    int          // 读取的行数
+		page    pageOpt      // 分页参数
 	}
 )
 
 //用于存储pg信息的包变量
 var (
-	finDB       *gorm.DB                      // 用于存储信息表所在库db连接
-	tables      dbConfTables                  // 用于存储信息表表名
-	taskPgInfos = make(map[string]pgConnInfo) // 用于存储所有任务的数据库连接信息
-	dbMap       = make(map[string]*gorm.DB)   // 用dsn=>db形式存储pg的连接，以dsn为key
-	pgFieldType = make(map[string]string)     // 字段名=>类型的形式存储所有字段的类型
+	finDB  *gorm.DB     // 用于存储信息表所在库db连接
+	tables dbConfTables // 用于存储信息表表名
 )
 
 /**
@@ -121,12 +151,14 @@ var pgLogLevel = map[string]logger.LogLevel{
 /*NewDB
  * @Description: 新建DB层接口
  * @Description: 完成pg库的db连接初始化，并返回配置表所在库的连接作为默认db连接
+ * @param l 应用日志，pg连接的日志同样输出到其中
  * @return db
  * @return cf
  * @return err
  */
-func NewDB() (db *gorm.DB, cf func(), err error) {
+func NewDB(l *applog.Logger) (db *gorm.DB, cf func(), err error) {
 	config.GetConfigure() // 加载配置
+	pgLogOut = l
 	db, err = defaultDbInit()
 	finDB = db
 	pgInit() // pg初始化
@@ -138,10 +170,8 @@ func NewDB() (db *gorm.DB, cf func(), err error) {
  * @Description: 关闭所有db连接
  */
 func Close() {
-	for _, d := range dbMap {
-		db, _ := d.DB()
-		_ = db.Close()
-	}
+	close(metaStop)
+	conns.closeAll()
 }
 
 /*
@@ -150,8 +180,9 @@ func Close() {
  * @return bool
  */
 func pgInit() {
-	// 初始化任务信息
-	errFatal(taskMapInit(finDB))
+	// 加载配置表缓存（含任务信息及定时任务）并定时刷新
+	errFatal(ReloadMeta())
+	metaRefresh()
 	// pg连接初始化
 	errFatal(setConns())
 }
@@ -162,7 +193,7 @@ func pgInit() {
  */
 func errFatal(err error) {
 	if err != nil {
-		log.Fatal(err)
+		applog.Fatal("pg init failed", "error", err)
 	}
 }
 
@@ -173,7 +204,15 @@ func errFatal(err error) {
 func defaultDbInit() (db *gorm.DB, err error) {
 	confTables := config.Tables()
 	dbCfg := config.DBCfg()
-	db, err = makePgConn(dbCfg.DefaultDSN)
+	if SetLogLevel(dbCfg.LogLevel) != nil {
+		_ = SetLogLevel("warn")
+	}
+	// DefaultDSN或其中的password可为密钥引用
+	dsn, err := resolveDSN(dbCfg.DefaultDSN)
+	if err != nil {
+		return
+	}
+	db, err = makePgConn(dsn, defaultPoolLimits())
 	if err != nil {
 		return
 	}
@@ -183,26 +222,18 @@ func defaultDbInit() (db *gorm.DB, err error) {
 }
 
 /*setConns
- * @Description: 将配置库中存储的pg库信息转化为固定格式的dsn并建立[dsn]db的map进行统一pg连接管理
+ * @Description: 将配置表所在库连接注册到连接池注册表并开始定时检查连接池
+ * @Description: 任务库在第一次使用时才建立连接
  * @return error
  */
 func setConns() (err error) {
-	dbCfg := config.DBCfg()
-	// 将存储信息表所在库db连接存入
-	dbMap[dbCfg.DefaultDSN] = finDB
-
-	for _, info := range taskPgInfos {
-		dsn := getPgDSN(info)
-		//判读该dsn在map中是否已存在
-		if _, ok := dbMap[dsn]; !ok {
-			dbMap[dsn], err = getPgConn(info)
-		}
-	}
+	conns.setDefault(config.DBCfg().DefaultDSN, finDB)
+	conns.janitor()
 	return
 }
 
 /**
- * @Description: 提供财务文件任务获取任务pg连接
+ * @Description: 提供财务文件任务获取任务pg连接，连接按dsn共用，未连接时建立
  * @param taskName
  * @return db
  * @return err
@@ -212,40 +243,19 @@ func getTaskDb(taskName string) (db *gorm.DB, err error) {
 	if err != nil {
 		return
 	}
-	dsn := getPgDSN(info)
-	if _, ok := dbMap[dsn]; !ok {
-		db, err = getPgConn(info)
-		dbMap[dsn] = db
-	} else {
-		db = dbMap[dsn]
-	}
-	return
+	return conns.get(getPgDSN(info), taskPoolLimits(taskName))
 }
 
-/*taskMapInit
- * @Description: 初始化任务信息
- * @return error
+/**
+ * @Description: 关闭已不被任何任务使用的pg连接（任务删除或连接信息修改后），配置库连接不关闭
+ * @param m 刷新后的配置缓存
  */
-func taskMapInit(db *gorm.DB) (err error) {
-	querySql := fmt.Sprintf("SELECT taskname,cron,server,username,passwd,database from %s.%s where export = 2;",
-		tables.schemaName, tables.taskInfo)
-	fmt.Println(querySql)
-	rows, err := db.Raw(querySql).Rows() // 使用原生sql进行查询
-	if err != nil {
-		return
-	}
-	//逐行处理查询结果
-	for rows.Next() {
-		var taskName, cron, server, username, passwd, database string
-		err = rows.Scan(&taskName, &cron, &server, &username, &passwd, &database)
-		if err != nil {
-			break
-		} else {
-			AppendCron(taskName, cron)
-			taskPgInfos[taskName] = getInfo(server, username, passwd, database)
-		}
+func closeStalePools(m *metaSnapshot) {
+	inUse := map[string]bool{config.DBCfg().DefaultDSN: true}
+	for _, task := range m.tasks {
+		inUse[getPgDSN(task.info)] = true
 	}
-	return
+	conns.retain(inUse)
 }
 
 /*getInfo
@@ -259,65 +269,114 @@ func taskMapInit(db *gorm.DB) (err error) {
 func getInfo(server string, username string, passwd string, database string) (info pgConnInfo) {
 	tmp := strings.Split(server, ":")
 	info.host = tmp[0]
-	info.port, _ = strconv.Atoi(tmp[1])
+	info.port = 5432 // 未配置端口时为pg默认端口
+	if len(tmp) > 1 {
+		info.port, _ = strconv.Atoi(tmp[1])
+	}
 	info.user = username
 	info.passwd = passwd
 	info.dbname = database
 	return
 }
 
-/**
- * @Description: 获取pg库连接
- * @param info
- * @return db
- * @return err
- */
-func getPgConn(info pgConnInfo) (db *gorm.DB, err error) {
-	return makePgConn(getPgDSN(info))
-}
-
 /**
  * @Description: 通过dsn创建pg连接对象
  * @param dsn
+ * @param limits 连接池大小限制
  * @return db
  * @return err
  */
-func makePgConn(dsn string) (db *gorm.DB, err error) {
-	dbCfg := config.DBCfg()
-	level := logger.Warn
-	if _, ok := pgLogLevel[dbCfg.LogLevel]; ok {
-		level = pgLogLevel[dbCfg.LogLevel]
-	}
+func makePgConn(dsn string, limits poolLimits) (db *gorm.DB, err error) {
 	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{
 		NamingStrategy: schema.NamingStrategy{
 			TablePrefix:   "",
 			SingularTable: true,
 		},
-		Logger: logger.Default.LogMode(level),
+		Logger: pgLogger,
 	})
 	if err != nil {
 		return
 	}
 
-	// 设置请求超时时间
-	db.Exec(fmt.Sprintf("set statement_timeout to %d", dbCfg.QueryTimeout))
-	// 连接设置初始化
+	// 连接设置初始化，sql超时在每个sql的事务中设置
+
 	d, err := db.DB()
 	if err != nil {
 		return
 	}
-	d.SetMaxIdleConns(dbCfg.MaxIdleConns)
-	d.SetMaxOpenConns(dbCfg.MaxOpenConns)
+	d.SetMaxIdleConns(limits.maxIdle)
+	d.SetMaxOpenConns(limits.maxOpen)
+	d.SetConnMaxLifetime(limits.maxLifetime)
 	return
 }
 
 /**
- * @Description: 将pg库信息转化为相应dsn
+ * @Description: 将pg库信息转化为相应dsn，值中含空格、引号等时加引号转义
  * @param info
  * @return string
  */
 func getPgDSN(info pgConnInfo) string {
-	pgsqlDSN := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s",
-		info.host, info.port, info.user, info.passwd, info.dbname)
-	return pgsqlDSN
+	o := info.opts
+	params := [][2]string{
+		{"host", info.host},
+		{"port", strconv.Itoa(info.port)},
+		{"user", info.user},
+		{"password", info.passwd},
+		{"dbname", info.dbname},
+	}
+	// 可选参数为空时不加入
+	for _, p := range [][2]string{
+		{"sslmode", o.sslMode},
+		{"sslrootcert", o.sslRootCert},
+		{"sslcert", o.sslCert},
+		{"sslkey", o.sslKey},
+		{"application_name", o.applicationName},
+		{"search_path", o.searchPath},
+	} {
+		if p[1] != "" {
+			params = append(params, p)
+		}
+	}
+	if o.connectTimeout > 0 {
+		params = append(params, [2]string{"connect_timeout", strconv.Itoa(o.connectTimeout)})
+	}
+	kvs := make([]string, 0, len(params))
+	for _, p := range params {
+		kvs = append(kvs, p[0]+"="+dsnValue(p[1]))
+	}
+	return strings.Join(kvs, " ")
+}
+
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+/**
+ * @Description: 转义dsn中的值，为空或含空白、引号、反斜杠时以单引号包围
+ * @param v
+ * @return string
+ */
+func dsnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\r\n'\\") {
+		return v
+	}
+	return "'" + dsnEscaper.Replace(v) + "'"
+}
+
+/**
+ * @Description: 获取任务的可选连接参数，DbCfg.TaskConns中未配置的项取全局配置
+ * @param taskName
+ * @return connOptions
+ */
+func taskConnOptions(taskName string) connOptions {
+	dbCfg := config.DBCfg()
+	o := connOptions{applicationName: dbCfg.ApplicationName}
+	tc, ok := dbCfg.TaskConns[taskName]
+	if !ok {
+		return o
+	}
+	if tc.ApplicationName != "" {
+		o.applicationName = tc.ApplicationName
+	}
+	o.sslMode, o.sslRootCert, o.sslCert, o.sslKey = tc.SSLMode, tc.SSLRootCert, tc.SSLCert, tc.SSLKey
+	o.connectTimeout, o.searchPath = tc.ConnectTimeout, tc.SearchPath
+	return o
 }
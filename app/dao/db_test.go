@@ -0,0 +1,44 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDSNValue(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{"secret", "secret"},
+		{"", "''"},
+		{"a b", "'a b'"},
+		{"it's", `'it\'s'`},
+		{`a\b`, `'a\\b'`},
+		{"x' host=evil", `'x\' host=evil'`},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, dsnValue(c.value), c.value)
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	cases := []struct {
+		dsn  string
+		want string
+	}{
+		{"host=pg user=u password=secret dbname=fin", "host=pg user=u password=*** dbname=fin"},
+		{"host=pg password='a b\\' c' dbname=fin", "host=pg password=*** dbname=fin"},
+		{"host=pg password=" + dsnValue("x' host=evil") + " port=5432", "host=pg password=*** port=5432"},
+		{"host=pg dbname=fin", "host=pg dbname=fin"},
+		{"postgres://u:secret@pg:5432/fin?sslmode=disable", "postgres://u:***@pg:5432/fin?sslmode=disable"},
+		{"postgresql://u@pg/fin?password=secret&sslmode=disable", "postgresql://u@pg/fin?password=***&sslmode=disable"},
+		{"postgres://u:p%40ss@pg/fin?sslmode=disable&password=secret", "postgres://u:***@pg/fin?sslmode=disable&password=***"},
+		{"postgres://pg/fin", "postgres://pg/fin"},
+		{"postgres://u:sec ret@pg:bad/fin", "postgres://***"},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, redactDSN(c.dsn), c.dsn)
+	}
+}
@@ -8,12 +8,17 @@ purpose:sql加载与执行
 */
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/lib/pq"
 	"github.com/pkg/errors"
 	"gorm.io/gorm"
+	"pg-adapter/app/config"
 	mar "pg-adapter/app/dao/market"
+	"pg-adapter/app/trace"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +33,9 @@ const (
 	opCode         //按代码导出
 )
 
+// procNames 各导出类型对应的配置表sql字段名
+var procNames = [...]string{opAll: "allproc", opBbrq: "repproc", opRtime: "finproc", opReal: "realproc", opCode: "codeproc"}
+
 // 财务数据特殊字段名
 const (
 	CODE     = "code"
@@ -50,8 +58,15 @@ const (
 	DATATYPE  = "datatype"  // 字段
 	CODELIST  = "codelist"  // 代码
 	TYPE      = "type"      // 导出类型
+	CURSOR    = "cursor"    // 分页游标
+	MERGE     = "merge"     // 多个财务文件合并方式
+	SNAPSHOT  = "snapshot"  // 快照日期
+	ASOF      = "asof"      // 时点，按src-time还原该时刻的数据
 )
 
+// codePattern 合法的证券代码，仅允许字母、数字及 . _ -
+var codePattern = regexp.MustCompile(`^[0-9A-Za-z._-]+$`)
+
 // 财务数据类型，对应pg配置库cj_index中的cj_type
 const (
 	pgTypeChar   = "C" // 字符
@@ -67,35 +82,115 @@ const (
 type exportHandle struct {
 	finName string // 财务文件名
 	// pg库交互
-	db      *gorm.DB  //执行所需连接
-	rows    *sql.Rows //pg sql 查询结构
-	procSql string    //执行的sql
+	ctx      context.Context //请求的ctx，用于取消sql及链路追踪
+	db       *gorm.DB        //执行所需连接
+	tx       *sql.Tx         //执行sql的事务，sql、游标及其会话设置均在该事务的连接上
+	rows     *sql.Rows       //pg sql 查询结构
+	procSql  string          //执行的sql
+	args     sqlArgs         //procSql中$n占位符对应的绑定参数，请求中的值均通过绑定参数传入
+	filter   *rowFilter      //读取结果时的过滤，用于无法改写sql的存储过程
+	ordered  bool            //sql结果已按市场、代码、日期、rtime排序
+	snapshot int             //快照日期，不为0时每个代码的每个字段只保留该日期及之前最新的非空值
+	asof     string          //时点，不为空时只保留src-time在该时刻及之前的版本
+	page     pageOpt         //分页参数，limit为0时不分页
+	begin    time.Time       //开始执行查询的时间，读取完结果后记录sql耗时
 	// 默认非存储过程且不需要操作索引开关
 	funcFlag  bool //是否是存储过程，true为是
 	indexFlag bool //索引开关，注：财务数据sql性能过差导致finance账号默认索引关闭，部分sql如需使用需要手动开启
+	rowCnt    int  //读取的行数
 }
 
 /*StartHandle
  * @Description: 导出查询处理
- * @param qp
+ * @Description: ctxValue中带有WRITER时数据逐条写入writer，返回的QueryRet中不含数据
+ * @Description: 否则配置了RowLimit时按游标分页，每次至多返回RowLimit条，还有数据时返回下一页游标，分页在sql中进行，见pageHandles
+ * @Description: 请求合并时所有handle的数据按(market, code, datetime)合并后再输出或分页
+ * @param ctx
+ * @param ctxValue
  * @return error
  */
-func StartHandle(ctxValue map[string]interface{}) *QueryRet {
+func StartHandle(ctx context.Context, ctxValue map[string]interface{}) *QueryRet {
 	qr := &QueryRet{Data: make([]SchemaValue, 0)}
-	handles, err := paraAnalysis(ctxValue)
+	ctx, span := trace.Start(ctx, "StartHandle")
+	defer span.End()
+	handles, opt, err := paraAnalysis(ctxValue)
+	span.SetAttr("method", opt.method)
+	span.SetAttr("handles", len(handles))
 	if err != nil {
+		span.SetError(err)
 		qr.Code = 400
 		// TODO 错误码管理
 		// TODO error message管理
 		qr.Msg = err.Error()
 		return qr
 	}
+	qr.fields = opt.fields
+	limit := config.Setting().RowLimit
+	w, stream := ctxValue[WRITER].(RecordWriter)
+	if opt.merge != mergeNone {
+		// 合并时需等所有handle完成，先缓存合并后的数据
+		merged := newMergeBuffer(opt.merge, opt.snapshot)
+		setWriters(handles, &syncWriter{w: merged})
+		runHandles(ctx, handles, opt.method, qr)
+		return mergedResult(qr, merged.result(), w, opt.cursor, limit)
+	}
+	if stream {
+		// 流式输出时所有handle并发写入同一个writer，不分页
+		setWriters(handles, &syncWriter{w: w})
+	} else if limit > 0 {
+		// 分页时按财务文件依次执行，每个只读取本页剩余的条数
+		pageHandles(ctx, handles, opt.method, opt.cursor, limit, qr)
+		return qr
+	}
+	runHandles(ctx, handles, opt.method, qr)
+	return qr
+}
+
+/**
+ * @Description: 输出合并后的数据：w不为nil时排序后全部逐条写入w（与未合并的流式输出一致不分页），否则排序后分页（limit<=0时返回全部）
+ * @param qr
+ * @param records 合并后的数据
+ * @param w
+ * @param cursor
+ * @param limit
+ * @return *QueryRet
+ */
+func mergedResult(qr *QueryRet, records []Record, w RecordWriter, cursor *pageCursor, limit int) *QueryRet {
+	if limit <= 0 || w != nil {
+		cursor, limit = nil, 0
+	}
+	data, next := pageRecords(records, cursor, limit)
+	if w == nil {
+		qr.Data, qr.Cursor = data, next
+		return qr
+	}
+	for _, sv := range data {
+		for _, cv := range sv.Codelist {
+			for _, dv := range cv.TimeList {
+				if err := w.WriteRecord(Record{Schema: sv.Schema, Code: cv.Code, DateValue: dv}); err != nil {
+					qr.Msg += err.Error()
+					return qr
+				}
+			}
+		}
+	}
+	return qr
+}
+
+/**
+ * @Description: 并发执行所有handle，结果及错误信息汇总到qr中，并记录每个财务文件的耗时及错误
+ * @param ctx
+ * @param handles
+ * @param method 请求类型，用于指标标签
+ * @param qr
+ */
+func runHandles(ctx context.Context, handles []Handle, method string, qr *QueryRet) {
 	ch1 := make(chan Handle, 1)
 	cnt := 0
 	for _, handle := range handles {
 		var h = handle
 		go func() {
-			h.Start()
+			execHandle(ctx, method, h)
 			ch1 <- h
 		}()
 	}
@@ -112,23 +207,75 @@ func StartHandle(ctxValue map[string]interface{}) *QueryRet {
 			cnt++
 		}
 		if cnt == len(handles) {
-			return qr
+			return
 		}
 	}
 }
 
+/**
+ * @Description: 执行单个handle，记录链路追踪、指标及统计日志
+ * @param ctx
+ * @param method 请求类型
+ * @param h
+ */
+func execHandle(ctx context.Context, method string, h Handle) {
+	begin := time.Now()
+	ctx, span := trace.Start(ctx, "Handle.Start")
+	span.SetAttr("fin", h.fin())
+	h.Start(ctx)
+	span.SetAttr("rows", h.rowCount())
+	span.SetError(h.Error())
+	span.End()
+	observeHandle(method, h, time.Since(begin))
+}
+
+/**
+ * @Description: 为所有handle设置输出
+ * @param handles
+ * @param w
+ */
+func setWriters(handles []Handle, w RecordWriter) {
+	for _, handle := range handles {
+		handle.setWriter(w)
+	}
+}
+
 /**
  * @Description: 对query和export两种不同协议的请求的参数进行解析并返回公共接口实现多态
  * @param ctxValue
  * @return handles
+ * @return opt 与协议无关的公共参数
  * @return err
  */
-func paraAnalysis(ctxValue map[string]interface{}) (handles []Handle, err error) {
+func paraAnalysis(ctxValue map[string]interface{}) (handles []Handle, opt handleOpt, err error) {
+	var cursor string
 	if ctxValue[METHOD].(int) == QUERY {
-		handles, err = queryAnalysis(ctxValue[VALUE].(map[string]string))
+		opt.method = methodQuery
+		var merge string
+		var snapshot bool
+		switch qp := ctxValue[VALUE].(type) {
+		case *QueryBody:
+			handles, opt.fields, err = queryBodyAnalysis(qp)
+			cursor, merge, snapshot = qp.Cursor, qp.Merge, qp.Snapshot != 0
+		default:
+			handles, opt.fields, err = queryAnalysis(qp.(map[string]string))
+			cursor, merge = qp.(map[string]string)[CURSOR], qp.(map[string]string)[MERGE]
+			snapshot = strings.TrimSpace(qp.(map[string]string)[SNAPSHOT]) != ""
+		}
+		if err != nil {
+			return
+		}
+		opt.merge, err = parseMerge(merge)
+		opt.snapshot = snapshot
 	} else {
+		opt.method = methodExport
 		handles, err = exportAnalysis(ctxValue[VALUE].(map[string]string))
+		cursor = ctxValue[VALUE].(map[string]string)[CURSOR]
+	}
+	if err != nil {
+		return
 	}
+	opt.cursor, err = parseCursor(cursor)
 	if err != nil {
 		return
 	}
@@ -177,10 +324,29 @@ func (h *exportHandle) sqlPreTreat() {
 
 /**
  * @Description: 财务文件对应sql查询
+ * @Description: 每个sql在单独的事务中执行，会话设置以set local方式只作用于该事务所在的连接
+ * @Description: 执行成功后需调用sqlFinish关闭结果集并结束事务
  * @receiver h
  * @return error
  */
-func (h *exportHandle) sqlExec() error {
+func (h *exportHandle) sqlExec() (err error) {
+	// 直接使用database/sql执行，避免gorm对sql中?及@的改写
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return
+	}
+	if h.tx, err = sqlDB.BeginTx(h.context(), nil); err != nil {
+		h.tx = nil
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = h.sqlFinish(err)
+		}
+	}()
+	if err = h.setLocal(); err != nil {
+		return
+	}
 	if h.funcFlag {
 		// 存储过程
 		return h.funcExec()
@@ -190,6 +356,84 @@ func (h *exportHandle) sqlExec() error {
 	}
 }
 
+/**
+ * @Description: 设置事务内的会话参数：sql超时，以及需要时开启nestloop
+ * @receiver h
+ * @return error
+ */
+func (h *exportHandle) setLocal() error {
+	settings := []string{fmt.Sprintf("set local statement_timeout = %d", config.DBCfg().QueryTimeout)}
+	if h.indexFlag {
+		settings = append(settings, "set local enable_nestloop = on") //开启索引
+	}
+	for _, s := range settings {
+		begin := time.Now()
+		_, err := h.tx.ExecContext(h.context(), s)
+		h.trace(begin, s, nil, 0, err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+ * @Description: 关闭结果集并结束事务，err为nil时提交，否则回滚
+ * @Description: 记录查询的耗时，包括执行及读取全部结果
+ * @receiver h
+ * @param err 执行及处理结果的错误
+ * @return error 结束事务的错误
+ */
+func (h *exportHandle) sqlFinish(err error) error {
+	if h.rows != nil {
+		_ = h.rows.Close()
+		h.rows = nil
+	}
+	if !h.begin.IsZero() {
+		h.trace(h.begin, h.procSql, h.args, h.rowCnt, err)
+		h.begin = time.Time{}
+	}
+	if h.tx == nil {
+		return nil
+	}
+	tx := h.tx
+	h.tx = nil
+	if err != nil {
+		return tx.Rollback()
+	}
+	return tx.Commit()
+}
+
+/**
+ * @Description: 记录未经gorm执行的sql，与gorm执行的sql一样按pg日志等级输出：失败为error，慢sql为warn，其余为info
+ * @receiver h
+ * @param begin 开始执行的时间
+ * @param sql
+ * @param args sql的绑定参数
+ * @param rows 读取的行数
+ * @param err
+ */
+func (h *exportHandle) trace(begin time.Time, sql string, args sqlArgs, rows int, err error) {
+	pgLogger.Trace(h.context(), begin, func() (string, int64) {
+		if len(args) != 0 {
+			sql = fmt.Sprintf("%s %v", sql, []interface{}(args))
+		}
+		return sql, int64(rows)
+	}, err)
+}
+
+/**
+ * @Description: 执行sql使用的ctx，未设置时不可取消
+ * @receiver h
+ * @return context.Context
+ */
+func (h *exportHandle) context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
 /**
  * @Description: 执行存储过后获取数据
  * @receiver h
@@ -197,19 +441,23 @@ func (h *exportHandle) sqlExec() error {
  * @return rows
  */
 func (h *exportHandle) funcExec() (err error) {
-	// 多段连续要BEGIN END
-	// 获取存储过程的数据需要先执行生成临时缓存之后再通过fetch进一步获取数据
-	h.db.Exec("BEGIN;")
-	defer h.db.Exec("END;") //处理完后end
-	row := h.db.Raw(h.procSql).Row()
+	_, span := trace.Start(h.context(), "sql.func")
+	span.SetAttr("fin", h.finName)
+	span.SetAttr("db.statement", h.procSql)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	// 获取存储过程的数据需要先执行生成游标之后再通过fetch进一步获取数据，游标只在所在事务中有效
+	h.begin = time.Now()
+	row := h.tx.QueryRowContext(h.context(), h.procSql, h.args...)
 	var strFetchSql string
-	if h.db.Error != nil {
-		return h.db.Error
+	if err = row.Scan(&strFetchSql); err != nil {
+		return
 	}
-	err = row.Scan(&strFetchSql)
 	// fetch all in "strFetchSql"
-	strFetchSql = fmt.Sprintf("fetch all in %q", strFetchSql)
-	h.rows, err = h.db.Raw(strFetchSql).Rows()
+	strFetchSql = "fetch all in " + quoteIdent(strFetchSql)
+	h.rows, err = h.tx.QueryContext(h.context(), strFetchSql)
 	return
 }
 
@@ -219,28 +467,30 @@ func (h *exportHandle) funcExec() (err error) {
  * @return err
  */
 func (h *exportHandle) selectExec() (err error) {
-	if h.indexFlag {
-		h.db.Exec("set enable_nestloop = on;")        //开启索引
-		defer h.db.Exec("set enable_nestloop = off;") //执行sql后关闭索引
-	}
-	h.rows, err = h.db.Raw(h.procSql).Rows()
+	_, span := trace.Start(h.context(), "sql.select")
+	span.SetAttr("fin", h.finName)
+	span.SetAttr("db.statement", h.procSql)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	h.begin = time.Now()
+	h.rows, err = h.tx.QueryContext(h.context(), h.procSql, h.args...)
 	return
 }
 
 /**
- * @Description: 从文件信息表中获取财务文件所在任务名
+ * @Description: 从文件信息缓存中获取财务文件所在任务名
  * @param finaName 财务文件名
  * @return taskName 任务名
  */
 func getTaskName(finaName string) (taskName string, err error) {
-	querySql := fmt.Sprintf("SELECT taskname from %s.%s where finname = '%s' and isvalid = 2;",
-		tables.schemaName, tables.finInfo, finaName)
-	row := finDB.Raw(querySql).Row()
-	err = row.Scan(&taskName)
-	if err != nil {
+	fm, ok := getMeta().fins[finaName]
+	if !ok {
+		err = fmt.Errorf("finance %s not exists", finaName)
 		return
 	}
-	return
+	return fm.taskName, nil
 }
 
 /**
@@ -249,24 +499,24 @@ func getTaskName(finaName string) (taskName string, err error) {
  * @return string
  */
 func getSchema(finName string) (schemaName string, err error) {
-	// 仅限自营 finQuery=2
-	querySql := fmt.Sprintf("SELECT distinct schema from %s.%s where finname = '%s' limit 1;",
-		tables.schemaName, tables.fin2table, finName)
-	row := finDB.Raw(querySql).Row()
-	err = row.Scan(&schemaName)
-	return
+	fm, ok := getMeta().fins[finName]
+	if !ok || fm.schema == "" {
+		err = fmt.Errorf("schema of finance %s not exists", finName)
+		return
+	}
+	return fm.schema, nil
 }
 
 /**
- * @Description: 从数据库表中获取相应财务文件的数据库信息
+ * @Description: 从任务信息缓存中获取相应财务文件的数据库信息
  * @param taskName
  * @return pgInfo
  * @return err
  */
 func getTaskPgInfo(taskName string) (pgInfo pgConnInfo, err error) {
-	info, ok := taskPgInfos[taskName]
+	task, ok := getMeta().tasks[taskName]
 	if ok {
-		pgInfo = info
+		pgInfo, err = task.info, task.err
 	} else {
 		err = fmt.Errorf("task %s not exists", taskName)
 	}
@@ -280,20 +530,12 @@ func getTaskPgInfo(taskName string) (pgInfo pgConnInfo, err error) {
  * @return err
  */
 func getProcSqls(finName string) (Sqls procSQLs, err error) {
-	querySql := fmt.Sprintf("SELECT allproc,repproc,finproc,realproc,codeproc from %s.%s where finname = '%s' and isvalid = 2",
-		tables.schemaName, tables.finInfo, finName)
-	row := finDB.Raw(querySql).Row()
-	if finDB.Error != nil {
+	fm, ok := getMeta().fins[finName]
+	if !ok {
+		err = fmt.Errorf("finance %s not exists", finName)
 		return
 	}
-	var allSql, bbrqSql, rtimeSql, realSql, codeSql string
-	err = row.Scan(&allSql, &bbrqSql, &rtimeSql, &realSql, &codeSql)
-	if err != nil {
-		return
-	}
-	Sqls[opAll], Sqls[opBbrq], Sqls[opRtime], Sqls[opReal], Sqls[opCode] =
-		allSql, bbrqSql, rtimeSql, realSql, codeSql
-	return
+	return fm.sqls, nil
 }
 
 /**********************************
@@ -305,33 +547,48 @@ func getProcSqls(finName string) (Sqls procSQLs, err error) {
  * @receiver q
  * @return hr
  */
-func (q *finQuery) Start() {
+func (q *finQuery) Start(ctx context.Context) {
 	// TODO 对象复用
 	h, err := q.NewHandle()
 	if err != nil {
 		q.err = err
 		return
 	}
+	h.ctx = ctx
+	h.snapshot, h.asof, h.page = q.p.snapshot, q.p.asof, q.page
 	q.data.Schema, q.err = getSchema(q.f.finName)
 	if q.err != nil {
 		return
 	}
 	h.sqlPreTreat()
 	if h.funcFlag {
-		errMsg := fmt.Sprintf("datatypes %s are in finance %s which doesn`t suit this handle. Please use /export instead.\n",
-			q.f.dataTypes, q.f.finName)
-		q.err = errors.New(errMsg)
-		return
+		// 存储过程无法用with改写，执行后在读取结果时过滤市场代码并只保留所取字段
+		h.filter, q.err = q.rowFilter()
+	} else {
+		// 分页时由pageSql排序
+		h.ordered = config.DBCfg().OrderInSQL && h.page.limit == 0
+		h.procSql, h.args, q.err = q.sqlOperate(h.procSql, h.ordered)
 	}
-	h.procSql, q.err = q.sqlOperate(h.procSql)
 	if q.err != nil {
 		return
 	}
+	h.pageOperate()
 	q.err = h.sqlExec()
 	if q.err != nil {
 		return
 	}
-	defer h.rows.Close()
+	defer func() {
+		if err := h.sqlFinish(q.err); q.err == nil {
+			q.err = err
+		}
+	}()
+	defer func() {
+		q.rows = h.rowCnt
+	}()
+	if q.w != nil {
+		q.err = h.streamTransform(q.data.Schema, q.w)
+		return
+	}
 	q.data.Codelist, q.err = h.startTransform()
 	return
 }
@@ -358,9 +615,10 @@ func (q *finQuery) NewHandle() (*exportHandle, error) {
 	if err != nil {
 		return nil, err
 	}
-	baseSql := sqls[opBbrq]
-	baseSql = strings.Replace(baseSql, "[start]", strconv.Itoa(q.p.startdate), 1)
-	baseSql = strings.Replace(baseSql, "[end]", strconv.Itoa(q.p.enddate), 1)
+	baseSql, err := renderTemplate(sqls[opBbrq], sqlParams{start: q.p.startdate, end: q.p.enddate})
+	if err != nil {
+		return nil, err
+	}
 	return &exportHandle{finName: q.f.finName, procSql: baseSql, db: db}, nil
 }
 
@@ -372,6 +630,22 @@ func (q *finQuery) Data() SchemaValue {
 	return q.data
 }
 
+func (q *finQuery) setWriter(w RecordWriter) {
+	q.w = w
+}
+
+func (q *finQuery) fin() string {
+	return q.f.finName
+}
+
+func (q *finQuery) rowCount() int {
+	return q.rows
+}
+
+func (q *finQuery) setPage(p pageOpt) {
+	q.page = p
+}
+
 /**
  * @Description: 清理不在该财务文件下的市场
  * @receiver q
@@ -395,20 +669,76 @@ func (q finQuery) marketClean() map[int]string {
  * @return handles
  * @return err
  */
-func queryAnalysis(qp map[string]string) (handles []Handle, err error) {
-	handles = make([]Handle, 0)
-	finFields, err := getFinFields(qp[DATATYPE])
+func queryAnalysis(qp map[string]string) (handles []Handle, fields []string, err error) {
+	datetime := qp[DATETIME]
+	codelist := qp[CODELIST]
+	fp, err := getFinQueryParams(datetime, codelist, qp[SNAPSHOT])
 	if err != nil {
 		return
 	}
-	datetime := qp[DATETIME]
-	codelist := qp[CODELIST]
-	fp, err := getFinQueryParams(datetime, codelist)
+	if fp.asof, err = parseAsof(qp[ASOF]); err != nil {
+		return
+	}
+	return newQueryHandles(qp[DATATYPE], fp)
+}
+
+/**
+ * @Description: 对json请求体形式的query请求进行参数校验与解析，结果与表单形式一致
+ * @param qb
+ * @return handles
+ * @return err
+ */
+func queryBodyAnalysis(qb *QueryBody) (handles []Handle, fields []string, err error) {
+	if len(qb.Fields) == 0 {
+		err = errors.New("no fields please check!")
+		return
+	}
+	dataTypes := make([]string, 0, len(qb.Fields))
+	for _, field := range qb.Fields {
+		if field <= 0 {
+			err = fmt.Errorf("error fields param: invalid field id %d", field)
+			return
+		}
+		dataTypes = append(dataTypes, strconv.Itoa(field))
+	}
+	var fp queryPara
+	if qb.Snapshot != 0 {
+		if !isDate(qb.Snapshot) {
+			err = fmt.Errorf("error snapshot param: %d, should be YYYYMMDD", qb.Snapshot)
+			return
+		}
+		fp.setSnapshot(qb.Snapshot)
+	} else if fp.startdate, fp.enddate, err = getBodyDates(qb.Start, qb.End); err != nil {
+		err = fmt.Errorf("error start/end param: %s", err.Error())
+		return
+	}
+	if fp.asof, err = parseAsof(qb.Asof); err != nil {
+		return
+	}
+	fp.marketCodes, err = getBodyMarketCodes(qb.Markets)
 	if err != nil {
+		err = fmt.Errorf("error markets param: %s", err.Error())
 		return
 	}
-	for fin, fields := range finFields {
-		q := &finQuery{f: finance{fin, fields}, p: fp}
+	return newQueryHandles(strings.Join(dataTypes, ","), fp)
+}
+
+/**
+ * @Description: 按字段所属财务文件创建query处理对象
+ * @param datatype 字段id，以逗号隔开
+ * @param fp 财务文件层面的导出参数
+ * @return handles
+ * @return fields 按datatype顺序排列的所有字段名
+ * @return err
+ */
+func newQueryHandles(datatype string, fp queryPara) (handles []Handle, fields []string, err error) {
+	handles = make([]Handle, 0)
+	finFields, fields, err := getFinFields(datatype)
+	if err != nil {
+		return
+	}
+	for fin, finFieldNames := range finFields {
+		q := &finQuery{f: finance{fin, finFieldNames}, p: fp}
 		q.p.marketCodes = q.marketClean()
 		if len(q.p.marketCodes) != 0 {
 			handles = append(handles, q)
@@ -418,61 +748,107 @@ func queryAnalysis(qp map[string]string) (handles []Handle, err error) {
 }
 
 /**
- * @Description: 对同一个财务文件取多个市场时通过union对多段sql进行连接
- * @Description: TODO sql处理前后示例
+ * @Description: 对同一个财务文件取多个市场时通过union对多段sql进行连接，市场及代码以绑定参数传入
+ * @Description: 示例：with base as (原sql) select zqdm,market,bbrq,rtime,字段 from base where market = $1 and zqdm = any($2) union ...;
  * @receiver q
  * @param originalSql
+ * @param ordered 是否在sql中按 market,zqdm,bbrq,rtime 排序
  * @return sql
+ * @return args sql中$n对应的参数
  * @return err
  */
-func (q finQuery) sqlOperate(originalSql string) (sql string, err error) {
+func (q finQuery) sqlOperate(originalSql string, ordered bool) (sql string, args sqlArgs, err error) {
 	const BASE = "base"
 	// 去掉原sql末尾的空格和;
 	originalSql = strings.TrimRight(strings.TrimRight(originalSql, " "), ";")
 	baseSql := fmt.Sprintf("with %s as (%s)", BASE, originalSql)
 	cols := strings.Join(q.f.dataTypes, ",")
 	selectCols := fmt.Sprintf("select %s,%s,%s,%s,%s from %s", ZQDM, MARKET, BBRQ, RTIME, cols, BASE)
-	sqls := make([]string, 0)
-	for market, codelist := range q.p.marketCodes {
-		codes := strings.Split(codelist, ",")
-		filter := fmt.Sprintf(" where %s = %d", MARKET, market)
-		if codelist != "" {
-			// 将codelist组成 and zqdm in ('code01','code01')，例如 and zqdm in ('300033','300093')
-			filter = filter + fmt.Sprintf(" and %s in ('%s')", ZQDM, strings.Join(codes, "','"))
+	// 按市场排序，相同请求生成相同的sql
+	markets := make([]int, 0, len(q.p.marketCodes))
+	for market := range q.p.marketCodes {
+		markets = append(markets, market)
+	}
+	sort.Ints(markets)
+	sqls := make([]string, 0, len(markets))
+	for _, market := range markets {
+		codes, e := splitCodes(q.p.marketCodes[market])
+		if e != nil {
+			return "", nil, e
+		}
+		filter := fmt.Sprintf(" where %s = %s", MARKET, args.bind(market))
+		if len(codes) != 0 {
+			filter += fmt.Sprintf(" and %s = any(%s)", ZQDM, args.bind(codes))
+		}
+		if q.p.asof != "" {
+			filter += fmt.Sprintf(" and %s <= %s", RTIME, args.bind(q.p.asof))
 		}
 		sqls = append(sqls, selectCols+filter)
 	}
-	return baseSql + strings.Join(sqls, " union ") + ";", nil
+	sql = baseSql + strings.Join(sqls, " union ")
+	if q.p.snapshot != 0 {
+		// 快照时每个代码聚合为一条，结果已按市场、代码排序
+		sql = baseSql + snapshotSql(strings.Join(sqls, " union "), q.f.dataTypes, args.bind(strconv.Itoa(q.p.snapshot)))
+	} else if q.p.asof != "" {
+		// 时点查询只需每个代码每个日期最新的版本
+		sql = baseSql + asofSql(strings.Join(sqls, " union "))
+	} else if ordered {
+		sql += fmt.Sprintf(" order by %s,%s,%s,%s", MARKET, ZQDM, BBRQ, RTIME)
+	}
+	return sql + ";", args, nil
 }
 
 /**
  * @Description: 通过数据id获取相关的财务文件名，返回涉及到的每个财务文件的相关字段 map[string][]string
  * @param datatype
  * @return finFields
+ * @return fields 按datatype顺序排列的所有字段名
  * @return err
  */
-func getFinFields(datatype string) (finFields map[string][]string, err error) {
-	if datatype == "" {
-		err = errors.New("no datatype please check!")
+func getFinFields(datatype string) (finFields map[string][]string, fields []string, err error) {
+	ids, err := parseDataTypes(datatype)
+	if err != nil {
 		return
 	}
 	finFields = make(map[string][]string)
-	querySql := fmt.Sprintf("select cj_field,cj_table from %s.%s where dmno in (%s);",
-		tables.schemaName, tables.fieldInfo, datatype)
-	rows, err := finDB.Raw(querySql).Rows()
-	if err != nil {
-		return
+	names := make(map[int]string) // dmno => 字段名
+	metaFields := getMeta().fields
+	for _, dmno := range ids {
+		field, ok := metaFields[dmno]
+		if !ok {
+			continue
+		}
+		if _, ok = names[dmno]; ok {
+			continue
+		}
+		names[dmno] = strings.ToLower(field.name)
+		for _, finName := range field.fins {
+			finFields[finName] = append(finFields[finName], field.name)
+		}
 	}
-	var fieldName, finNames string
-	for rows.Next() {
-		err = rows.Scan(&fieldName, &finNames)
+	fields = orderFields(datatype, names)
+	return
+}
+
+/**
+ * @Description: 按请求中datatype的顺序排列字段名（sql结果中字段名均为小写），用于csv等需要固定列顺序的输出
+ * @param datatype 字段id，以逗号隔开
+ * @param names dmno => 字段名
+ * @return fields
+ */
+func orderFields(datatype string, names map[int]string) (fields []string) {
+	seen := make(map[string]bool)
+	for _, id := range strings.Split(datatype, ",") {
+		dmno, err := strconv.Atoi(strings.TrimSpace(id))
 		if err != nil {
-			return
+			continue
 		}
-		fins := strings.Split(finNames, ";")
-		for _, finName := range fins {
-			finFields[finName] = append(finFields[finName], fieldName)
+		name, ok := names[dmno]
+		if !ok || seen[name] {
+			continue
 		}
+		seen[name] = true
+		fields = append(fields, name)
 	}
 	return
 }
@@ -481,13 +857,22 @@ func getFinFields(datatype string) (finFields map[string][]string, err error) {
  * @Description: 获取财务文件层面的导出参数（区别于请求层面的参数
  * @param datetime startdate-enddate 例如：20210716-20210906，如果为空则为昨天到今天
  * @param codelist
+ * @param snapshot 快照日期 YYYYMMDD，不为空时忽略datetime
  * @return fp
  * @return err
  */
-func getFinQueryParams(datetime string, codelist string) (fp queryPara, err error) {
+func getFinQueryParams(datetime string, codelist string, snapshot string) (fp queryPara, err error) {
 	dateErr := "error datetime param"
 	codeErr := "error codelist param"
-	fp.startdate, fp.enddate, err = getDates(datetime)
+	date, err := parseSnapshot(snapshot)
+	if err != nil {
+		return
+	}
+	if date != 0 {
+		fp.setSnapshot(date)
+	} else {
+		fp.startdate, fp.enddate, err = getDates(datetime)
+	}
 	if err != nil {
 		errMsg := fmt.Sprintf("%s: %s", dateErr, err.Error())
 		err = errors.New(errMsg)
@@ -510,19 +895,125 @@ func getFinQueryParams(datetime string, codelist string) (fp queryPara, err erro
  * @return err
  */
 func getDates(datetime string) (startdate int, enddate int, err error) {
-	y, m, d := time.Now().Date()
-	enddate = y*10000 + int(m)*100 + d
-	startdate = enddate - 1
+	startdate, enddate = defaultDates()
 	dates := strings.Split(datetime, "-")
 	if len(dates) != 2 {
 		err = errors.New(" ")
 		return
 	}
 	if dates[0] != "" {
-		startdate, err = strconv.Atoi(dates[0])
+		if startdate, err = strconv.Atoi(dates[0]); err != nil {
+			return
+		}
 	}
 	if dates[1] != "" {
-		enddate, err = strconv.Atoi(dates[1])
+		if enddate, err = strconv.Atoi(dates[1]); err != nil {
+			return
+		}
+	}
+	if !isDate(startdate) || !isDate(enddate) {
+		err = fmt.Errorf("dates must be YYYYMMDD, got %d-%d", startdate, enddate)
+		return
+	}
+	if startdate > enddate {
+		err = fmt.Errorf("start %d is after end %d", startdate, enddate)
+	}
+	return
+}
+
+/**
+ * @Description: 校验json请求体中的起止日期，为0时与表单一致取昨天到今天
+ * @param start
+ * @param end
+ * @return startdate
+ * @return enddate
+ * @return err
+ */
+func getBodyDates(start int, end int) (startdate int, enddate int, err error) {
+	startdate, enddate = defaultDates()
+	if start != 0 {
+		startdate = start
+	}
+	if end != 0 {
+		enddate = end
+	}
+	if !isDate(startdate) || !isDate(enddate) {
+		err = fmt.Errorf("dates must be YYYYMMDD, got %d-%d", startdate, enddate)
+		return
+	}
+	if startdate > enddate {
+		err = fmt.Errorf("start %d is after end %d", startdate, enddate)
+	}
+	return
+}
+
+/**
+ * @Description: 默认的起止日期：昨天到今天
+ * @return startdate
+ * @return enddate
+ */
+func defaultDates() (startdate int, enddate int) {
+	now := time.Now()
+	return dateInt(now.AddDate(0, 0, -1)), dateInt(now)
+}
+
+/**
+ * @Description: 日期转化为YYYYMMDD形式的整数
+ * @param t
+ * @return int
+ */
+func dateInt(t time.Time) int {
+	y, m, d := t.Date()
+	return y*10000 + int(m)*100 + d
+}
+
+/**
+ * @Description: 判断是否为YYYYMMDD形式的合法日期
+ * @param date
+ * @return bool
+ */
+func isDate(date int) bool {
+	_, err := time.Parse("20060102", strconv.Itoa(date))
+	return err == nil
+}
+
+/**
+ * @Description: 将json请求体中的市场及代码转化为与codelist解析结果一致的形式
+ * @Description: 同一市场出现多次时代码合并，任意一次代码为空则取该市场下全部代码
+ * @param markets 示例：[{17 []} {33 [300033]}]
+ * @return mc 示例： map[17:"", 33:"300033"]
+ * @return err
+ */
+func getBodyMarketCodes(markets []MarketCodes) (mc map[int]string, err error) {
+	if len(markets) == 0 {
+		err = errors.New("no markets")
+		return
+	}
+	mc = make(map[int]string)
+	all := make(map[int]bool)
+	for _, m := range markets {
+		if m.Market < 0 {
+			err = fmt.Errorf("invalid market %d", m.Market)
+			return
+		}
+		if len(m.Codes) == 0 {
+			all[m.Market] = true
+		}
+		codes := make([]string, 0, len(m.Codes))
+		for _, code := range m.Codes {
+			if !codePattern.MatchString(code) {
+				err = fmt.Errorf("invalid code %q in market %d", code, m.Market)
+				return
+			}
+			codes = append(codes, code)
+		}
+		if mc[m.Market] != "" && len(codes) != 0 {
+			mc[m.Market] += ","
+		}
+		mc[m.Market] += strings.Join(codes, ",")
+	}
+	for market := range all {
+		mc[market] = ""
 	}
 	return
 }
@@ -546,10 +1037,17 @@ func getMarketCodes(codelist string) (mc map[int]string, err error) {
 			continue
 		}
 		s := strings.Split(c, "(")
+		if len(s) != 2 {
+			err = fmt.Errorf("invalid market codes %q", c)
+			return
+		}
 		market, err = strconv.Atoi(s[0])
 		if err != nil {
 			return
 		}
+		if _, err = splitCodes(s[1]); err != nil {
+			return
+		}
 		mc[market] = s[1]
 	}
 	return
@@ -564,12 +1062,14 @@ func getMarketCodes(codelist string) (mc map[int]string, err error) {
  * @receiver e
  * @return hr
  */
-func (e *finExport) Start() {
+func (e *finExport) Start(ctx context.Context) {
 	h, err := e.NewHandle()
 	if err != nil {
 		e.err = err
 		return
 	}
+	h.ctx = ctx
+	h.page = e.page
 	e.data.Schema, e.err = getSchema(e.finName)
 	if e.err != nil {
 		return
@@ -579,11 +1079,23 @@ func (e *finExport) Start() {
 	if e.err != nil {
 		return
 	}
+	h.pageOperate()
 	e.err = h.sqlExec()
 	if e.err != nil {
 		return
 	}
-	defer h.rows.Close()
+	defer func() {
+		if err := h.sqlFinish(e.err); e.err == nil {
+			e.err = err
+		}
+	}()
+	defer func() {
+		e.rows = h.rowCnt
+	}()
+	if e.w != nil {
+		e.err = h.streamTransform(e.data.Schema, e.w)
+		return
+	}
 	e.data.Codelist, e.err = h.startTransform()
 	return
 }
@@ -610,20 +1122,32 @@ func (e *finExport) NewHandle() (*exportHandle, error) {
 	if err != nil {
 		return nil, err
 	}
-	baseSql := sqls[opBbrq]
+	// 按导出类型选取对应的sql
+	baseSql := sqls[e.p.procType]
+	if strings.TrimSpace(baseSql) == "" {
+		return nil, fmt.Errorf("finance %s has no %s for export type %d", e.finName, procNames[e.p.procType], e.p.procType)
+	}
 	return &exportHandle{finName: e.finName, procSql: baseSql, db: db}, nil
 }
 
+/**
+ * @Description: 按导出类型替换sql中的 [start] [end] [codelist]，参数均经过校验
+ * @receiver e
+ * @param originalSql
+ * @return sql
+ * @return err
+ */
 func (e *finExport) sqlOperate(originalSql string) (sql string, err error) {
-	if e.p.procType == opRtime || e.p.procType == opBbrq {
-		sql = strings.Replace(originalSql, "[start]", strconv.Itoa(e.p.startDate), 1)
-		sql = strings.Replace(sql, "[end]", strconv.Itoa(e.p.endDate), 1)
-	} else if e.p.procType == opCode {
-		codes := strings.Split(e.p.codeList, ",")
-		codelist := fmt.Sprintf("'%s'", strings.Join(codes, "','"))
-		sql = strings.Replace(sql, "[codelist]", strings.TrimRight(codelist, ","), 1)
+	var p sqlParams
+	switch e.p.procType {
+	case opRtime, opBbrq:
+		p.start, p.end = e.p.startDate, e.p.endDate
+	case opCode:
+		if p.codes, err = splitCodes(e.p.codeList); err != nil {
+			return
+		}
 	}
-	return
+	return renderTemplate(originalSql, p)
 }
 
 func (e *finExport) Error() error {
@@ -634,6 +1158,22 @@ func (e *finExport) Data() SchemaValue {
 	return e.data
 }
 
+func (e *finExport) setWriter(w RecordWriter) {
+	e.w = w
+}
+
+func (e *finExport) fin() string {
+	return e.finName
+}
+
+func (e *finExport) rowCount() int {
+	return e.rows
+}
+
+func (e *finExport) setPage(p pageOpt) {
+	e.page = p
+}
+
 /**
  * @Description: 对export类型请求进行参数解析
  * @param qp
@@ -662,7 +1202,8 @@ func exportAnalysis(qp map[string]string) (handles []Handle, err error) {
 }
 
 /**
- * @Description: 获取适配老版协议的导出参数
+ * @Description: 获取适配老版协议的导出参数，并按导出类型校验所需参数
+ * @Description: 0全量、3实时不需要参数；1按日期、2按rtime需要合法的起止日期（缺省为昨天到今天）；4按代码需要codelist
  * @param qp
  * @return p
  * @return err
@@ -676,22 +1217,58 @@ func getExportParams(qp map[string]string) (p exportParam, err error) {
 	if err != nil {
 		return
 	}
-	y, m, d := time.Now().Date()
-	today := y*10000 + int(m)*100 + d
-	p.startDate = today - 1
-	p.endDate = today
-	if qp[STARTDATE] != "" {
-		p.startDate, err = strconv.Atoi(qp[STARTDATE])
-	}
-	if err != nil {
+	if p.procType < opAll || p.procType > opCode {
+		err = fmt.Errorf("error type param: %d, should be %d-%d", p.procType, opAll, opCode)
 		return
 	}
-	if qp[ENDDATE] != "" {
-		p.endDate, err = strconv.Atoi(qp[ENDDATE])
+	p.startDate, p.endDate = defaultDates()
+	// 仅按日期、按rtime导出使用起止日期
+	if p.procType == opBbrq || p.procType == opRtime {
+		if p.startDate, p.endDate, err = getExportDates(qp[STARTDATE], qp[ENDDATE]); err != nil {
+			return
+		}
 	}
+	codes, err := splitCodes(qp[CODELIST])
 	if err != nil {
+		err = fmt.Errorf("error codelist param: %s", err.Error())
+		return
+	}
+	if p.procType == opCode && len(codes) == 0 {
+		err = fmt.Errorf("error codelist param: export type %d requires codelist", opCode)
 		return
 	}
 	p.codeList = qp[CODELIST]
 	return
 }
+
+/**
+ * @Description: 解析并校验导出的起止日期，为空时取昨天到今天
+ * @param start
+ * @param end
+ * @return startdate
+ * @return enddate
+ * @return err
+ */
+func getExportDates(start string, end string) (startdate int, enddate int, err error) {
+	startdate, enddate = defaultDates()
+	if start != "" {
+		if startdate, err = strconv.Atoi(start); err != nil {
+			err = fmt.Errorf("error startdate param: %q", start)
+			return
+		}
+	}
+	if end != "" {
+		if enddate, err = strconv.Atoi(end); err != nil {
+			err = fmt.Errorf("error enddate param: %q", end)
+			return
+		}
+	}
+	if !isDate(startdate) || !isDate(enddate) {
+		err = fmt.Errorf("error startdate/enddate param: dates must be YYYYMMDD, got %d-%d", startdate, enddate)
+		return
+	}
+	if startdate > enddate {
+		err = fmt.Errorf("error startdate/enddate param: start %d is after end %d", startdate, enddate)
+	}
+	return
+}
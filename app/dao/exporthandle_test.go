@@ -0,0 +1,38 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBodyMarketCodes(t *testing.T) {
+	cases := []struct {
+		name    string
+		markets []MarketCodes
+		want    map[int]string
+		wantErr bool
+	}{
+		{"empty", nil, nil, true},
+		{"all codes", []MarketCodes{{Market: 17}}, map[int]string{17: ""}, false},
+		{"codes", []MarketCodes{{Market: 33, Codes: []string{"300033", "300093"}}}, map[int]string{33: "300033,300093"}, false},
+		{"same market merged", []MarketCodes{{Market: 33, Codes: []string{"300033"}}, {Market: 33, Codes: []string{"300093"}}},
+			map[int]string{33: "300033,300093"}, false},
+		{"empty codes wins", []MarketCodes{{Market: 33, Codes: []string{"300033"}}, {Market: 33}, {Market: 17, Codes: []string{"600000"}}},
+			map[int]string{33: "", 17: "600000"}, false},
+		{"negative market", []MarketCodes{{Market: -1}}, nil, true},
+		{"quote", []MarketCodes{{Market: 33, Codes: []string{"300033'"}}}, nil, true},
+		{"injection", []MarketCodes{{Market: 33, Codes: []string{"1');drop table taskitems;--"}}}, nil, true},
+		{"comma", []MarketCodes{{Market: 33, Codes: []string{"300033,300093"}}}, nil, true},
+		{"empty code", []MarketCodes{{Market: 33, Codes: []string{""}}}, nil, true},
+	}
+	for _, c := range cases {
+		mc, err := getBodyMarketCodes(c.markets)
+		if c.wantErr {
+			assert.NotNil(t, err, c.name)
+			continue
+		}
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.want, mc, c.name)
+	}
+}
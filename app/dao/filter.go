@@ -0,0 +1,81 @@
+package dao
+
+/*
+author:heqimin
+purpose:存储过程结果的市场代码过滤及字段投影，存储过程无法通过sql改写过滤，在读取结果时处理
+*/
+
+import (
+	"strconv"
+	"strings"
+)
+
+/**
+ * @Description: 按市场代码过滤结果行，并只保留所取字段
+ */
+type rowFilter struct {
+	markets map[string]map[string]bool // 市场号=>代码，代码为空则取该市场下全部代码
+	fields  map[string]bool            // 所取字段（小写），code、market、datetime、src-time始终保留
+}
+
+/**
+ * @Description: 由query参数创建过滤对象
+ * @receiver q
+ * @return *rowFilter
+ * @return error
+ */
+func (q finQuery) rowFilter() (*rowFilter, error) {
+	f := &rowFilter{markets: make(map[string]map[string]bool), fields: make(map[string]bool)}
+	for market, codelist := range q.p.marketCodes {
+		codes, err := splitCodes(codelist)
+		if err != nil {
+			return nil, err
+		}
+		set := make(map[string]bool, len(codes))
+		for _, code := range codes {
+			set[code] = true
+		}
+		f.markets[strconv.Itoa(market)] = set
+	}
+	for _, field := range q.f.dataTypes {
+		f.fields[strings.ToLower(field)] = true
+	}
+	return f, nil
+}
+
+/**
+ * @Description: 判断结果行是否在所取的市场代码中
+ * @Description: 结果中没有市场字段时（财务文件只属于一个市场）按所有市场的代码判断
+ * @receiver f
+ * @param market
+ * @param code
+ * @return bool
+ */
+func (f *rowFilter) match(market string, code string) bool {
+	market = strings.TrimSpace(market)
+	code = strings.TrimSpace(code)
+	if market != "" {
+		codes, ok := f.markets[market]
+		return ok && (len(codes) == 0 || codes[code])
+	}
+	for _, codes := range f.markets {
+		if len(codes) == 0 || codes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * @Description: 判断字段是否需要输出
+ * @receiver f
+ * @param col 转换后的字段名
+ * @return bool
+ */
+func (f *rowFilter) keep(col string) bool {
+	switch col {
+	case CODE, MARKET, DATETIME, srcTime:
+		return true
+	}
+	return f.fields[col]
+}
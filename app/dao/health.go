@@ -0,0 +1,160 @@
+package dao
+
+/*
+author:heqimin
+purpose:pg连接健康检查
+*/
+
+import (
+	"context"
+	"gorm.io/gorm"
+	"pg-adapter/app/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 健康状态
+const (
+	StatusUp      = "up"
+	StatusDown    = "down"
+	StatusUnknown = "unknown" // 任务库尚未连接（未使用或空闲回收），不影响整体状态
+)
+
+// 未配置时单个连接ping的超时时间
+const defaultPingTimeout = 2 * time.Second
+
+type (
+	// PoolHealth 单个pg连接的健康状态
+	PoolHealth struct {
+		DSN     string   `json:"dsn"`             // 密码已脱敏
+		Default bool     `json:"default"`         // 是否为配置表所在库
+		Tasks   []string `json:"tasks,omitempty"` // 使用该连接的任务
+		Status  string   `json:"status"`          // up/down/unknown
+		Latency float64  `json:"latency_ms"`      // ping耗时，毫秒
+		Error   string   `json:"error,omitempty"` // 失败原因
+	}
+
+	// HealthRet 健康检查结果，没有down的连接时为up
+	HealthRet struct {
+		Status string       `json:"status"`
+		Checks []PoolHealth `json:"checks"`
+	}
+
+	// healthTarget 需要检查的连接
+	healthTarget struct {
+		dsn       string
+		isDefault bool
+		tasks     []string
+		err       error // 任务连接信息错误（如密码引用解析失败）
+	}
+)
+
+/*Health
+ * @Description: 并发ping配置表所在库及配置表中所有任务的库，单个连接超时时间为DbCfg.PingTimeout
+ * @Description: 任务库未连接时：最近一次连接或检查失败（已被回收）为down，否则为unknown
+ * @param ctx
+ * @return *HealthRet
+ */
+func Health(ctx context.Context) *HealthRet {
+	timeout := config.DBCfg().PingTimeout * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultPingTimeout
+	}
+	targets := healthTargets()
+	checks := make([]PoolHealth, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		checks[i] = PoolHealth{DSN: redactDSN(t.dsn), Default: t.isDefault, Tasks: t.tasks, Status: StatusUp}
+		if t.err != nil {
+			checks[i].Status, checks[i].Error = StatusDown, t.err.Error()
+			continue
+		}
+		d := targetDB(t)
+		if d == nil {
+			if t.isDefault {
+				checks[i].Status, checks[i].Error = StatusDown, "default database is not connected"
+			} else if msg, ok := conns.failure(t.dsn); ok {
+				checks[i].Status, checks[i].Error = StatusDown, msg
+			} else {
+				checks[i].Status, checks[i].Error = StatusUnknown, "not connected"
+			}
+			continue
+		}
+		db, err := d.DB()
+		if err != nil {
+			checks[i].Status, checks[i].Error = StatusDown, err.Error()
+			continue
+		}
+		wg.Add(1)
+		go func(ph *PoolHealth) {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			begin := time.Now()
+			err := db.PingContext(pingCtx)
+			ph.Latency = float64(time.Since(begin).Microseconds()) / 1000
+			if err != nil {
+				ph.Status, ph.Error = StatusDown, err.Error()
+			}
+		}(&checks[i])
+	}
+	wg.Wait()
+
+	ret := &HealthRet{Status: StatusUp, Checks: checks}
+	for _, ph := range checks {
+		if ph.Status == StatusDown {
+			ret.Status = StatusDown
+		}
+	}
+	return ret
+}
+
+/**
+ * @Description: 获取需要检查的连接：配置表所在库在前，其后为配置表中所有任务的库（按dsn排序，共用dsn的任务合并）
+ * @return []healthTarget
+ */
+func healthTargets() []healthTarget {
+	targets := []healthTarget{{dsn: config.DBCfg().DefaultDSN, isDefault: true}}
+	index := make(map[string]int) // dsn => 在targets中的位置
+	tasks := getMeta().tasks
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		task := tasks[name]
+		dsn := getPgDSN(task.info)
+		i, ok := index[dsn]
+		if !ok {
+			i = len(targets)
+			index[dsn] = i
+			targets = append(targets, healthTarget{dsn: dsn})
+		}
+		targets[i].tasks = append(targets[i].tasks, name)
+		if task.err != nil && targets[i].err == nil {
+			targets[i].err = task.err
+		}
+	}
+	taskTargets := targets[1:]
+	sort.Slice(taskTargets, func(i, j int) bool {
+		return taskTargets[i].dsn < taskTargets[j].dsn
+	})
+	return targets
+}
+
+/**
+ * @Description: 获取已建立的连接，不建立新连接
+ * @param t
+ * @return *gorm.DB 未连接时为nil
+ */
+func targetDB(t healthTarget) *gorm.DB {
+	if t.isDefault {
+		return finDB
+	}
+	if p := conns.lookup(t.dsn); p != nil {
+		return p.sqlDB()
+	}
+	return nil
+}
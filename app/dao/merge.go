@@ -0,0 +1,152 @@
+package dao
+
+/*
+author:heqimin
+purpose:将多个财务文件的结果按市场、代码、日期合并为一条数据
+*/
+
+import (
+	"fmt"
+	"strings"
+)
+
+// src-time冲突时的合并策略
+const (
+	mergeNone     = ""         // 不合并，每个财务文件单独返回
+	mergeLatest   = "latest"   // 同一字段取src-time最新的值，合并后的src-time为最新的src-time
+	mergeEarliest = "earliest" // 同一字段取src-time最早的值，合并后的src-time为最早的src-time
+)
+
+/**
+ * @Description: 解析merge参数
+ * @param s 为空、0、false时不合并；1、true、latest为latest；earliest为earliest
+ * @return policy
+ * @return err
+ */
+func parseMerge(s string) (policy string, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "0", "false":
+		return mergeNone, nil
+	case "1", "true", mergeLatest:
+		return mergeLatest, nil
+	case mergeEarliest:
+		return mergeEarliest, nil
+	default:
+		return "", fmt.Errorf("error merge param: %q, should be %s or %s", s, mergeLatest, mergeEarliest)
+	}
+}
+
+/**
+ * @Description: 合并的关联键
+ */
+type mergeKey struct {
+	market   string
+	code     string
+	datetime int
+}
+
+/**
+ * @Description: 合并后单个字段值的来源，用于判断冲突时是否替换
+ */
+type mergeSource struct {
+	datetime int    // 值所在数据的datetime，仅快照合并时比较
+	srcTime  string // 值所在数据的src-time
+	fin      string // 值所在的财务文件
+}
+
+/**
+ * @Description: 合并中的单条数据
+ */
+type mergedRecord struct {
+	rec     Record
+	sources map[string]mergeSource // 字段名=>值的来源
+}
+
+/**
+ * @Description: 接收所有handle的数据并按(market, code, datetime)合并，合并后的数据不属于任何财务文件，排序及分组时以库名代替财务文件名
+ * @Description: 快照时各财务文件快照的datetime可能不同，按(market, code)合并，每个字段取datetime、src-time最新的非空值
+ */
+type mergeBuffer struct {
+	policy   string
+	snapshot bool
+	records  map[mergeKey]*mergedRecord
+}
+
+func newMergeBuffer(policy string, snapshot bool) *mergeBuffer {
+	return &mergeBuffer{policy: policy, snapshot: snapshot, records: make(map[mergeKey]*mergedRecord)}
+}
+
+func (b *mergeBuffer) WriteRecord(r Record) error {
+	key := mergeKey{market: r.Market, code: r.Code, datetime: r.DateTime}
+	if b.snapshot {
+		key.datetime = 0
+	}
+	src := mergeSource{datetime: r.DateTime, srcTime: r.SrcTime, fin: r.fin}
+	m, ok := b.records[key]
+	if !ok {
+		m = &mergedRecord{rec: r, sources: make(map[string]mergeSource, len(r.Value))}
+		m.rec.fin = r.Schema
+		m.rec.Value = make(RowValue, len(r.Value))
+		b.records[key] = m
+	} else {
+		if b.prefer(src, mergeSource{datetime: m.rec.DateTime, srcTime: m.rec.SrcTime}) {
+			m.rec.DateTime, m.rec.SrcTime = r.DateTime, r.SrcTime
+		}
+		// 不同库的财务文件合并时取库名较小的，保证结果确定
+		if r.Schema < m.rec.Schema {
+			m.rec.Schema, m.rec.fin = r.Schema, r.Schema
+		}
+	}
+	for field, v := range r.Value {
+		if v == nil && b.snapshot {
+			// 快照中的空值说明该财务文件中没有值，不覆盖其他财务文件的值
+			if _, ok := m.rec.Value[field]; !ok {
+				m.rec.Value[field] = nil
+			}
+			continue
+		}
+		if old, ok := m.sources[field]; ok && !b.prefer(src, old) {
+			continue
+		}
+		m.rec.Value[field] = v
+		m.sources[field] = src
+	}
+	return nil
+}
+
+/**
+ * @Description: 判断冲突时是否以a替换b：快照时datetime较新的优先；再按策略比较src-time，空的src-time优先级最低，相同时取财务文件名较小的
+ * @receiver b
+ * @param a
+ * @param o
+ * @return bool
+ */
+func (b *mergeBuffer) prefer(a mergeSource, o mergeSource) bool {
+	if b.snapshot && a.datetime != o.datetime {
+		return a.datetime > o.datetime
+	}
+	if a.srcTime != o.srcTime {
+		if a.srcTime == "" || o.srcTime == "" {
+			return o.srcTime == ""
+		}
+		// src-time为 YYYY-MM-DD hh:ii:ss.micro 的格式，可直接按字符串比较
+		if b.policy == mergeEarliest {
+			return a.srcTime < o.srcTime
+		}
+		return a.srcTime > o.srcTime
+	}
+	return a.fin < o.fin
+}
+
+/**
+ * @Description: 获取合并后的所有数据（无序）
+ * @receiver b
+ * @return []Record
+ */
+func (b *mergeBuffer) result() []Record {
+	records := make([]Record, 0, len(b.records))
+	for _, m := range b.records {
+		records = append(records, m.rec)
+	}
+	return records
+}
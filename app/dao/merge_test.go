@@ -0,0 +1,76 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMerge(t *testing.T) {
+	for s, want := range map[string]string{"": mergeNone, "0": mergeNone, "true": mergeLatest, " Latest ": mergeLatest, "earliest": mergeEarliest} {
+		policy, err := parseMerge(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, want, policy, s)
+	}
+	_, err := parseMerge("newest")
+	assert.NotNil(t, err)
+}
+
+func TestMergeBuffer(t *testing.T) {
+	rec := func(schema string, fin string, srcTime string, v RowValue) Record {
+		return Record{Schema: schema, Code: "600000", fin: fin,
+			DateValue: DateValue{DateTime: 20210803, SrcTime: srcTime, Market: "17", Value: v}}
+	}
+	records := []Record{
+		rec("shasefin", "b.fin", "2021-08-03 10:00:00.000000", RowValue{"f1": 1.0, "f2": "b"}),
+		rec("shasefin", "a.fin", "2021-08-03 09:00:00.000000", RowValue{"f1": 2.0, "f3": int64(3)}),
+		rec("sharefin", "c.fin", "", RowValue{"f1": 4.0, "f4": nil}),
+		rec("shasefin", "d.fin", "2021-08-03 10:00:00.000000", RowValue{"f2": "d"}),
+	}
+	cases := []struct {
+		policy  string
+		srcTime string
+		value   RowValue
+	}{
+		// 同一字段取src-time最新的，相同时取财务文件名较小的，空src-time优先级最低
+		{mergeLatest, "2021-08-03 10:00:00.000000", RowValue{"f1": 1.0, "f2": "b", "f3": int64(3), "f4": nil}},
+		{mergeEarliest, "2021-08-03 09:00:00.000000", RowValue{"f1": 2.0, "f2": "b", "f3": int64(3), "f4": nil}},
+	}
+	for _, c := range cases {
+		b := newMergeBuffer(c.policy, false)
+		for _, r := range records {
+			assert.Nil(t, b.WriteRecord(r))
+		}
+		// 另一日期单独为一条
+		other := rec("shasefin", "a.fin", "", RowValue{"f1": 5.0})
+		other.DateTime = 20210804
+		assert.Nil(t, b.WriteRecord(other))
+
+		result := b.result()
+		assert.Len(t, result, 2, c.policy)
+		for _, r := range result {
+			if r.DateTime != 20210803 {
+				continue
+			}
+			assert.Equal(t, "sharefin", r.Schema, c.policy)
+			assert.Equal(t, "sharefin", r.fin, c.policy)
+			assert.Equal(t, c.srcTime, r.SrcTime, c.policy)
+			assert.Equal(t, c.value, r.Value, c.policy)
+		}
+	}
+}
+
+func TestMergeBufferSnapshot(t *testing.T) {
+	rec := func(fin string, datetime int, v RowValue) Record {
+		return Record{Schema: "shasefin", Code: "600000", fin: fin,
+			DateValue: DateValue{DateTime: datetime, SrcTime: "2021-08-03 10:00:00.000000", Market: "17", Value: v}}
+	}
+	b := newMergeBuffer(mergeLatest, true)
+	// 各财务文件快照的datetime不同，按代码合并，每个字段取datetime最新的非空值
+	assert.Nil(t, b.WriteRecord(rec("a.fin", 20210802, RowValue{"f1": 1.0, "f2": "a", "f3": nil})))
+	assert.Nil(t, b.WriteRecord(rec("b.fin", 20210803, RowValue{"f1": 2.0, "f2": nil, "f4": nil})))
+	result := b.result()
+	assert.Len(t, result, 1)
+	assert.Equal(t, 20210803, result[0].DateTime)
+	assert.Equal(t, RowValue{"f1": 2.0, "f2": "a", "f3": nil, "f4": nil}, result[0].Value)
+}
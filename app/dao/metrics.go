@@ -0,0 +1,100 @@
+package dao
+
+import (
+	applog "pg-adapter/app/logger"
+	"pg-adapter/app/metrics"
+	"time"
+)
+
+// 指标标签中的请求类型
+const (
+	methodQuery  = "query"
+	methodExport = "export"
+	methodTask   = "task"
+)
+
+// 指标标签中的执行结果
+const (
+	resultOk    = "ok"
+	resultError = "error"
+)
+
+var (
+	handleTotal = metrics.NewCounterVec("pg_adapter_fin_handles_total",
+		"Number of finance file handles executed.", "method", "fin", "result")
+	handleErrors = metrics.NewCounterVec("pg_adapter_fin_handle_errors_total",
+		"Number of finance file handles that returned an error.", "method", "fin")
+	handleDuration = metrics.NewHistogramVec("pg_adapter_fin_handle_duration_seconds",
+		"Duration of finance file handles including sql execution and transform.", nil, "method", "fin")
+	rowsTotal = metrics.NewCounterVec("pg_adapter_fin_rows_total",
+		"Number of rows read from postgres per finance file.", "fin")
+	taskDuration = metrics.NewHistogramVec("pg_adapter_task_export_duration_seconds",
+		"Duration of scheduled task exports.", nil, "task")
+	taskTotal = metrics.NewCounterVec("pg_adapter_task_exports_total",
+		"Number of scheduled task exports.", "task", "result")
+)
+
+func init() {
+	poolGauge := func(name string, help string, typ string, value func(s PoolStat) float64) {
+		metrics.NewFuncVec(name, help, typ, func() []metrics.Sample {
+			stats := PoolStats()
+			samples := make([]metrics.Sample, 0, len(stats))
+			for _, s := range stats {
+				samples = append(samples, metrics.Sample{LabelValues: []string{s.DSN}, Value: value(s)})
+			}
+			return samples
+		}, "dsn")
+	}
+	poolGauge("pg_adapter_db_max_open_connections", "Maximum number of open connections to the database.",
+		metrics.TypeGauge, func(s PoolStat) float64 { return float64(s.MaxOpenConnections) })
+	poolGauge("pg_adapter_db_open_connections", "Number of established connections both in use and idle.",
+		metrics.TypeGauge, func(s PoolStat) float64 { return float64(s.OpenConnections) })
+	poolGauge("pg_adapter_db_in_use_connections", "Number of connections currently in use.",
+		metrics.TypeGauge, func(s PoolStat) float64 { return float64(s.InUse) })
+	poolGauge("pg_adapter_db_idle_connections", "Number of idle connections.",
+		metrics.TypeGauge, func(s PoolStat) float64 { return float64(s.Idle) })
+	poolGauge("pg_adapter_db_wait_count_total", "Total number of connections waited for.",
+		metrics.TypeCounter, func(s PoolStat) float64 { return float64(s.WaitCount) })
+	poolGauge("pg_adapter_db_wait_duration_seconds_total", "Total time blocked waiting for a new connection.",
+		metrics.TypeCounter, func(s PoolStat) float64 { return s.WaitDuration.Seconds() })
+	poolGauge("pg_adapter_db_max_idle_closed_total", "Total number of connections closed due to SetMaxIdleConns.",
+		metrics.TypeCounter, func(s PoolStat) float64 { return float64(s.MaxIdleClosed) })
+	poolGauge("pg_adapter_db_max_lifetime_closed_total", "Total number of connections closed due to SetConnMaxLifetime.",
+		metrics.TypeCounter, func(s PoolStat) float64 { return float64(s.MaxLifetimeClosed) })
+}
+
+// unknownFin 不存在的财务文件在指标中的标签值
+const unknownFin = "unknown"
+
+/**
+ * @Description: 财务文件名作为指标标签，名字来自请求参数，配置表中不存在的统一为unknown，避免标签无限增长
+ * @param fin
+ * @return string
+ */
+func finLabel(fin string) string {
+	if _, ok := getMeta().fins[fin]; ok {
+		return fin
+	}
+	return unknownFin
+}
+
+/**
+ * @Description: 记录单个handle的执行结果及耗时，并输出一行统计日志
+ * @param method 请求类型
+ * @param h
+ * @param d 耗时
+ */
+func observeHandle(method string, h Handle, d time.Duration) {
+	result := resultOk
+	errMsg := ""
+	fin := finLabel(h.fin())
+	if h.Error() != nil {
+		result = resultError
+		errMsg = h.Error().Error()
+		handleErrors.Inc(method, fin)
+	}
+	handleTotal.Inc(method, fin, result)
+	handleDuration.Observe(d.Seconds(), method, fin)
+	applog.Stat("fin", "method", method, "fin", h.fin(), "rows", h.rowCount(),
+		"duration_ms", d.Milliseconds(), "error", errMsg)
+}
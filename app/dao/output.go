@@ -0,0 +1,264 @@
+package dao
+
+/*
+author:heqimin
+purpose:将请求结果转化为表格类输出格式
+*/
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"pg-adapter/pkg/parquet"
+	"strconv"
+	"strings"
+)
+
+// 表格输出中除数据字段外的固定列
+var baseColumns = []string{SCHEMA, CODE, MARKET, DATETIME, srcTime}
+
+/*WriteCSV
+ * @Description: 将请求结果展开为csv，每个代码的每个日期一行
+ * @Description: 列为 schema,code,market,datetime,src-time,<字段...>，字段顺序见QueryRet.Fields
+ * @param w
+ * @param qr
+ * @return error
+ */
+func WriteCSV(w io.Writer, qr *QueryRet) error {
+	fields := qr.Fields()
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append(append([]string{}, baseColumns...), fields...)); err != nil {
+		return err
+	}
+	line := make([]string, len(baseColumns)+len(fields))
+	for _, sv := range qr.Data {
+		for _, cv := range sv.Codelist {
+			for _, dv := range cv.TimeList {
+				line[0], line[1], line[2], line[3], line[4] =
+					sv.Schema, cv.Code, dv.Market, strconv.Itoa(dv.DateTime), dv.SrcTime
+				for i, field := range fields {
+					line[len(baseColumns)+i] = csvValue(dv.Value[field])
+				}
+				if err := cw.Write(line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+/**
+ * @Description: 单个字段值转化为csv中的字符串，空值为空字符串，浮点数不使用科学计数法
+ * @param v
+ * @return string
+ */
+func csvValue(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+/*WriteParquet
+ * @Description: 将请求结果写为parquet，列与csv一致
+ * @Description: 字段类型取自字段信息表的cj_type：D为double，L为int64，T为YYYYMMDD形式的int32，其余为字符串
+ * @Description: 有值与cj_type不符时该列退为double或字符串，见parquetColumnType
+ * @param w
+ * @param qr
+ * @return error
+ */
+func WriteParquet(w io.Writer, qr *QueryRet) error {
+	fields := qr.Fields()
+	types := getFieldTypes(fields)
+	cols := []parquet.Column{
+		{Name: SCHEMA, Type: parquet.String},
+		{Name: CODE, Type: parquet.String},
+		{Name: MARKET, Type: parquet.String},
+		{Name: DATETIME, Type: parquet.Int32},
+		{Name: srcTime, Type: parquet.String},
+	}
+	for _, field := range fields {
+		cols = append(cols, parquet.Column{Name: field, Type: parquetColumnType(field, types[field], qr)})
+	}
+	pw, err := parquet.NewWriter(w, cols)
+	if err != nil {
+		return err
+	}
+	row := make([]interface{}, len(cols))
+	for _, sv := range qr.Data {
+		for _, cv := range sv.Codelist {
+			for _, dv := range cv.TimeList {
+				row[0], row[1], row[2], row[3], row[4] = sv.Schema, cv.Code, dv.Market, dv.DateTime, dv.SrcTime
+				for i, field := range fields {
+					col := len(baseColumns) + i
+					row[col], _ = parquetValue(dv.Value[field], cols[col].Type)
+				}
+				if err = pw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return pw.Close()
+}
+
+/**
+ * @Description: 将请求结果写为parquet文件，先写临时文件再重命名，避免读到写了一半的文件
+ * @param path
+ * @param qr
+ * @return error
+ */
+func writeParquetFile(path string, qr *QueryRet) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	err = WriteParquet(f, qr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+/**
+ * @Description: cj_type转化为parquet列类型
+ * @param fType
+ * @return parquet.Type
+ */
+func parquetType(fType string) parquet.Type {
+	switch fType {
+	case pgTypeDouble:
+		return parquet.Double
+	case pgTypeLong:
+		return parquet.Int64
+	case pgTypeTime:
+		return parquet.Int32
+	default:
+		return parquet.String
+	}
+}
+
+/**
+ * @Description: 确定字段的parquet列类型，优先按cj_type
+ * @Description: 字段信息表中错误较多，有值无法无损转换为该类型时，数值列退为double，仍不行时退为字符串，不丢弃数据
+ * @param field
+ * @param fType cj_type
+ * @param qr
+ * @return parquet.Type
+ */
+func parquetColumnType(field string, fType string, qr *QueryRet) parquet.Type {
+	candidates := []parquet.Type{parquetType(fType)}
+	if candidates[0] != parquet.String {
+		if candidates[0] != parquet.Double {
+			candidates = append(candidates, parquet.Double)
+		}
+		candidates = append(candidates, parquet.String)
+	}
+	t := candidates[0]
+	for _, sv := range qr.Data {
+		for _, cv := range sv.Codelist {
+			for _, dv := range cv.TimeList {
+				for t != parquet.String {
+					if _, ok := parquetValue(dv.Value[field], t); ok {
+						break
+					}
+					candidates = candidates[1:]
+					t = candidates[0]
+				}
+			}
+		}
+	}
+	return t
+}
+
+/**
+ * @Description: 字段值转化为parquet列类型对应的值，空值为nil
+ * @param v
+ * @param t
+ * @return interface{}
+ * @return bool 非空值无法无损转换为该类型时为false
+ */
+func parquetValue(v interface{}, t parquet.Type) (interface{}, bool) {
+	switch value := v.(type) {
+	case nil:
+		return nil, true
+	case float64:
+		switch t {
+		case parquet.String:
+			return csvValue(value), true
+		case parquet.Double:
+			return value, true
+		}
+		if value != math.Trunc(value) || math.Abs(value) >= 1<<53 {
+			return nil, false
+		}
+		if t == parquet.Int32 {
+			if value < math.MinInt32 || value > math.MaxInt32 {
+				return nil, false
+			}
+			return int32(value), true
+		}
+		return int64(value), true
+	case int64:
+		switch t {
+		case parquet.String:
+			return csvValue(value), true
+		case parquet.Double:
+			return float64(value), true
+		case parquet.Int32:
+			if value < math.MinInt32 || value > math.MaxInt32 {
+				return nil, false
+			}
+			return int32(value), true
+		}
+		return value, true
+	case int:
+		return parquetValue(int64(value), t)
+	case string:
+		s := strings.TrimSpace(value)
+		if s == "" {
+			return nil, true
+		}
+		switch t {
+		case parquet.String:
+			return s, true
+		case parquet.Double:
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f, true
+			}
+		case parquet.Int64:
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return n, true
+			}
+		case parquet.Int32:
+			if n, err := strconv.ParseInt(s, 10, 32); err == nil {
+				return int32(n), true
+			}
+		}
+		return nil, false
+	default:
+		if t == parquet.String {
+			return csvValue(value), true
+		}
+		return nil, false
+	}
+}
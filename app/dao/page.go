@@ -0,0 +1,315 @@
+package dao
+
+/*
+author:heqimin
+purpose:按游标分页返回数据
+*/
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pageCols 分页时附加在sql结果中的排序键：market、zqdm、bbrq、rtime在pg中格式化后的文本，为空时为空字符串
+// 游标中的值均取自这些列，与sql中的比较一致，不受go与pg会话时区不同的影响
+var pageCols = [...]string{"pg_page_market", "pg_page_code", "pg_page_date", "pg_page_time"}
+
+// errPageFull 存储过程的结果已读取够一页，停止读取
+var errPageFull = errors.New("page full")
+
+/**
+ * @Description: 分页游标，记录上一页最后一条数据的位置，对外为base64编码后的json
+ * @Description: sql结果中为排序键及与该键相同的数据中已返回的条数；存储过程的结果无法在sql中排序，N为该财务文件已返回的条数
+ */
+type pageCursor struct {
+	Fin      string `json:"f"` // 财务文件名
+	Market   string `json:"m"` // 市场
+	Code     string `json:"c"` // 代码
+	DateTime string `json:"d"` // 日期 YYYYMMDD
+	SrcTime  string `json:"s"` // src-time
+	N        int    `json:"n"` // 与该位置相同的数据中已返回的条数，存储过程为已返回的条数
+}
+
+/**
+ * @Description: 单个handle的分页参数
+ */
+type pageOpt struct {
+	cursor *pageCursor // 该财务文件上一页的位置，为nil时从头开始
+	limit  int         // 至多读取的条数，为0时不分页
+}
+
+/**
+ * @Description: 解析请求中的游标
+ * @param s 上一页返回的cursor，为空时返回nil
+ * @return *pageCursor
+ * @return error
+ */
+func parseCursor(s string) (*pageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	c := new(pageCursor)
+	if err = json.Unmarshal(b, c); err != nil || c.N < 0 {
+		return nil, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+/**
+ * @Description: 游标编码
+ * @receiver c
+ * @return string
+ */
+func (c pageCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+/**
+ * @Description: 数据排序规则：财务文件、市场、代码、日期、src-time（不比较N）
+ * @receiver c
+ * @param o
+ * @return bool
+ */
+func (c pageCursor) less(o pageCursor) bool {
+	if c.Fin != o.Fin {
+		return c.Fin < o.Fin
+	}
+	if c.Market != o.Market {
+		return c.Market < o.Market
+	}
+	if c.Code != o.Code {
+		return c.Code < o.Code
+	}
+	if c.DateTime != o.DateTime {
+		return c.DateTime < o.DateTime
+	}
+	return c.SrcTime < o.SrcTime
+}
+
+/**
+ * @Description: 是否为同一财务文件中的同一排序键
+ * @receiver c
+ * @param o
+ * @return bool
+ */
+func (c pageCursor) sameKey(o pageCursor) bool {
+	return !c.less(o) && !o.less(c)
+}
+
+/**
+ * @Description: 已返回的条数，存储过程按该条数跳过
+ * @receiver o
+ * @return int
+ */
+func (o pageOpt) offset() int {
+	if o.cursor == nil {
+		return 0
+	}
+	return o.cursor.N
+}
+
+/**
+ * @Description: 在sql中按游标分页：附加排序键后按 market,zqdm,bbrq,rtime 排序，从游标位置开始取limit条
+ * @Description: 键相同的数据以整行文本排序，offset跳过上一页已返回的与游标键相同的条数
+ * @Description: 示例：select * from (select s.*,market::text as pg_page_market,... from (原sql) s) p where (排序键) >= ($1,$2,$3,$4) order by 排序键,p::text offset $5 limit $6;
+ * @Description: 原sql的结果中需含有market、zqdm、bbrq、rtime列
+ * @param originalSql
+ * @param cursor 为nil时从第一条开始
+ * @param limit
+ * @param args 原sql的绑定参数，分页参数追加在其后
+ * @return string
+ */
+func pageSql(originalSql string, cursor *pageCursor, limit int, args *sqlArgs) string {
+	originalSql = strings.TrimRight(strings.TrimSpace(originalSql), ";")
+	keys := fmt.Sprintf("%s::text as %s,%s::text as %s,coalesce(to_char(%s,'YYYYMMDD'),'') as %s,coalesce(to_char(%s,'YYYY-MM-DD HH24:MI:SS.US'),'') as %s",
+		MARKET, pageCols[0], ZQDM, pageCols[1], BBRQ, pageCols[2], RTIME, pageCols[3])
+	order := strings.Join(pageCols[:], ",")
+	where, offset := "", 0
+	if cursor != nil {
+		where = fmt.Sprintf(" where (%s) >= (%s,%s,%s,%s)", order,
+			args.bind(cursor.Market), args.bind(cursor.Code), args.bind(cursor.DateTime), args.bind(cursor.SrcTime))
+		offset = cursor.N
+	}
+	return fmt.Sprintf("select * from (select s.*,%s from (%s) s) p%s order by %s,p::text offset %s limit %s;",
+		keys, originalSql, where, order, args.bind(offset), args.bind(limit))
+}
+
+/**
+ * @Description: 分页时需要在sql中排序及截取，存储过程在读取结果时跳过已返回的条数
+ * @receiver h
+ */
+func (h *exportHandle) pageOperate() {
+	if h.page.limit > 0 && !h.funcFlag {
+		h.procSql = pageSql(h.procSql, h.page.cursor, h.page.limit, &h.args)
+	}
+}
+
+/**
+ * @Description: 计算当前行的位置，需在读取该行后、读取下一行前调用
+ * @Description: sql结果取pageCols中的排序键，N为与该键相同的数据中已返回的条数；存储过程N为已返回的条数
+ * @receiver cp
+ * @param code
+ * @param dv
+ * @return pageCursor
+ */
+func (cp *colsProc) position(code string, dv DateValue) pageCursor {
+	pos := pageCursor{Fin: cp.finName, Market: dv.Market, Code: code, DateTime: strconv.Itoa(dv.DateTime), SrcTime: dv.SrcTime}
+	if cp.proc || cp.pageIdx == nil {
+		pos.N = cp.page.offset() + cp.rowCnt + 1
+		return pos
+	}
+	key := [...]*string{&pos.Market, &pos.Code, &pos.DateTime, &pos.SrcTime}
+	for i, idx := range cp.pageIdx {
+		*key[i] = string(cp.row.values[idx])
+	}
+	switch {
+	case cp.rowCnt > 0 && pos.sameKey(cp.last):
+		pos.N = cp.last.N + 1
+	case cp.page.cursor != nil && pos.sameKey(*cp.page.cursor):
+		pos.N = cp.page.cursor.N + 1
+	default:
+		pos.N = 1
+	}
+	cp.last = pos
+	return pos
+}
+
+/**
+ * @Description: 找到sql结果中的排序键列，这些列不输出
+ * @param colNames
+ * @param skip
+ * @return []int 各排序键在结果中的位置，不完整时为nil
+ */
+func pageColumns(colNames []string, skip []bool) []int {
+	idx := make([]int, 0, len(pageCols))
+	for _, col := range pageCols {
+		for i, name := range colNames {
+			if name == col {
+				idx = append(idx, i)
+				skip[i] = true
+			}
+		}
+	}
+	if len(idx) != len(pageCols) {
+		return nil
+	}
+	return idx
+}
+
+/**
+ * @Description: 缓存一个handle本页读取的数据
+ */
+type pageWriter struct {
+	records []Record
+}
+
+func (w *pageWriter) WriteRecord(r Record) error {
+	w.records = append(w.records, r)
+	return nil
+}
+
+/**
+ * @Description: 分页执行：按财务文件名依次执行handle，每个handle只读取本页剩余条数+1条，多出的一条说明还有数据
+ * @Description: 游标所在财务文件之前的handle不执行，内存中至多缓存一页数据
+ * @param ctx
+ * @param handles
+ * @param method 请求类型，用于指标标签
+ * @param cursor 上一页的游标
+ * @param limit 每页条数
+ * @param qr
+ */
+func pageHandles(ctx context.Context, handles []Handle, method string, cursor *pageCursor, limit int, qr *QueryRet) {
+	sort.SliceStable(handles, func(i, j int) bool {
+		return handles[i].fin() < handles[j].fin()
+	})
+	page := make([]Record, 0)
+	for _, h := range handles {
+		var c *pageCursor
+		if cursor != nil {
+			if h.fin() < cursor.Fin {
+				continue
+			}
+			if h.fin() == cursor.Fin {
+				c = cursor
+			}
+		}
+		rest := limit - len(page)
+		w := new(pageWriter)
+		h.setWriter(w)
+		h.setPage(pageOpt{cursor: c, limit: rest + 1})
+		execHandle(ctx, method, h)
+		if h.Error() != nil {
+			qr.Msg += h.Error().Error()
+		}
+		if len(w.records) > rest {
+			page = append(page, w.records[:rest]...)
+			qr.Cursor = page[len(page)-1].pos.String()
+			break
+		}
+		page = append(page, w.records...)
+	}
+	qr.Data = groupRecords(page)
+}
+
+/**
+ * @Description: 合并后的数据在内存中分页：(财务文件, market, code, datetime)唯一，排序后取游标之后的至多limit条
+ * @param records
+ * @param cursor
+ * @param limit 为0时返回全部
+ * @return data
+ * @return next 还有剩余数据时为下一页游标，否则为空
+ */
+func pageRecords(records []Record, cursor *pageCursor, limit int) (data []SchemaValue, next string) {
+	for i := range records {
+		r := &records[i]
+		r.pos = pageCursor{Fin: r.fin, Market: r.Market, Code: r.Code, DateTime: strconv.Itoa(r.DateTime), SrcTime: r.SrcTime}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].pos.less(records[j].pos)
+	})
+	start := 0
+	if cursor != nil {
+		start = sort.Search(len(records), func(i int) bool {
+			return cursor.less(records[i].pos)
+		})
+	}
+	end := len(records)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+		next = records[end-1].pos.String()
+	}
+	return groupRecords(records[start:end]), next
+}
+
+/**
+ * @Description: 将有序的数据按财务文件、代码组装成返回格式
+ * @param records
+ * @return []SchemaValue
+ */
+func groupRecords(records []Record) []SchemaValue {
+	svs := make([]SchemaValue, 0)
+	for i := range records {
+		r := &records[i]
+		if i == 0 || r.fin != records[i-1].fin {
+			svs = append(svs, SchemaValue{Schema: r.Schema, Codelist: make([]CodeValue, 0)})
+		}
+		sv := &svs[len(svs)-1]
+		if i == 0 || r.fin != records[i-1].fin || r.Market != records[i-1].Market || r.Code != records[i-1].Code {
+			sv.Codelist = append(sv.Codelist, CodeValue{Code: r.Code, TimeList: make([]DateValue, 0)})
+		}
+		cv := &sv.Codelist[len(sv.Codelist)-1]
+		cv.TimeList = append(cv.TimeList, r.DateValue)
+	}
+	return svs
+}
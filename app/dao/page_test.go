@@ -0,0 +1,119 @@
+package dao
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPageSql(t *testing.T) {
+	const keys = "select * from (select s.*,market::text as pg_page_market,zqdm::text as pg_page_code," +
+		"coalesce(to_char(bbrq,'YYYYMMDD'),'') as pg_page_date,coalesce(to_char(rtime,'YYYY-MM-DD HH24:MI:SS.US'),'') as pg_page_time" +
+		" from (select * from t where market = $1) s) p"
+	const order = " order by pg_page_market,pg_page_code,pg_page_date,pg_page_time,p::text"
+	args := sqlArgs{17}
+	sql := pageSql("select * from t where market = $1; ", nil, 3, &args)
+	assert.Equal(t, keys+order+" offset $2 limit $3;", sql)
+	assert.Equal(t, sqlArgs{17, 0, 3}, args)
+
+	// 游标以绑定参数传入，offset跳过与游标键相同的已返回条数
+	args = sqlArgs{17}
+	c := &pageCursor{Fin: "a.fin", Market: "17", Code: "600000'", DateTime: "20210803", SrcTime: "", N: 2}
+	sql = pageSql("select * from t where market = $1;", c, 3, &args)
+	assert.Equal(t, keys+" where (pg_page_market,pg_page_code,pg_page_date,pg_page_time) >= ($2,$3,$4,$5)"+order+" offset $6 limit $7;", sql)
+	assert.Equal(t, sqlArgs{17, "17", "600000'", "20210803", "", 2, 3}, args)
+}
+
+func TestPosition(t *testing.T) {
+	row := func(cp *colsProc, key ...string) pageCursor {
+		for i, k := range key {
+			cp.row.values[i] = sql.RawBytes(k)
+		}
+		pos := cp.position(key[1], DateValue{})
+		cp.rowCnt++
+		return pos
+	}
+	cursor := &pageCursor{Fin: "a.fin", Market: "17", Code: "600000", DateTime: "20210803", SrcTime: "", N: 2}
+	cp := &colsProc{finName: "a.fin", row: &colValue{values: make([]sql.RawBytes, 4)}, pageIdx: []int{0, 1, 2, 3},
+		page: pageOpt{cursor: cursor, limit: 4}}
+	// 与游标键相同的数据接着游标中的N计数，其余按键重新计数
+	assert.Equal(t, 3, row(cp, "17", "600000", "20210803", "").N)
+	assert.Equal(t, 4, row(cp, "17", "600000", "20210803", "").N)
+	assert.Equal(t, 1, row(cp, "17", "600000", "20210804", "").N)
+	pos := row(cp, "17", "600000", "20210804", "")
+	assert.Equal(t, pageCursor{Fin: "a.fin", Market: "17", Code: "600000", DateTime: "20210804", N: 2}, pos)
+
+	// 存储过程按已返回的条数
+	cp = &colsProc{finName: "b.fin", proc: true, page: pageOpt{cursor: &pageCursor{Fin: "b.fin", N: 5}, limit: 4}}
+	assert.Equal(t, 6, cp.position("600000", DateValue{}).N)
+	cp.rowCnt++
+	assert.Equal(t, 7, cp.position("600000", DateValue{}).N)
+}
+
+func TestPageColumns(t *testing.T) {
+	skip := make([]bool, 6)
+	idx := pageColumns([]string{"code", "pg_page_market", "f1", "pg_page_code", "pg_page_date", "pg_page_time"}, skip)
+	assert.Equal(t, []int{1, 3, 4, 5}, idx)
+	assert.Equal(t, []bool{false, true, false, true, true, true}, skip)
+	assert.Nil(t, pageColumns([]string{"code", "pg_page_market"}, make([]bool, 2)))
+}
+
+func TestPageRecords(t *testing.T) {
+	rec := func(fin string, code string, datetime int) Record {
+		// 合并后的数据以库名代替财务文件名
+		return Record{Schema: fin, Code: code, fin: fin,
+			DateValue: DateValue{DateTime: datetime, Market: "17", Value: RowValue{}}}
+	}
+	// 乱序的合并结果
+	records := []Record{
+		rec("shasefin", "600001", 20210803),
+		rec("sharefin", "600000", 20210803),
+		rec("shasefin", "600000", 20210804),
+		rec("shasefin", "600000", 20210803),
+	}
+	want := []string{"sharefin:600000:20210803", "shasefin:600000:20210803", "shasefin:600000:20210804", "shasefin:600001:20210803"}
+	data, next := pageRecords(records, nil, 0)
+	assert.Equal(t, "", next)
+	assert.Len(t, data, 2)
+
+	for _, limit := range []int{1, 2, 3, 4} {
+		var got []string
+		var cursor *pageCursor
+		for pages := 0; ; pages++ {
+			data, next := pageRecords(records, cursor, limit)
+			for _, sv := range data {
+				for _, cv := range sv.Codelist {
+					for _, dv := range cv.TimeList {
+						got = append(got, sv.Schema+":"+cv.Code+":"+strconv.Itoa(dv.DateTime))
+					}
+				}
+			}
+			if next == "" {
+				break
+			}
+			var err error
+			cursor, err = parseCursor(next)
+			assert.Nil(t, err)
+			if pages > len(records) {
+				t.Fatalf("limit %d: paging does not end", limit)
+			}
+		}
+		// 分页拼接后与一次取全部的结果一致
+		assert.Equal(t, want, got, "limit %d", limit)
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	c, err := parseCursor("")
+	assert.Nil(t, err)
+	assert.Nil(t, c)
+	c, err = parseCursor(pageCursor{Fin: "a.fin", Code: "600000", DateTime: "20210803", N: 2}.String())
+	assert.Nil(t, err)
+	assert.Equal(t, pageCursor{Fin: "a.fin", Code: "600000", DateTime: "20210803", N: 2}, *c)
+	for _, s := range []string{"!!", "bm90IGpzb24", pageCursor{N: -1}.String()} {
+		_, err = parseCursor(s)
+		assert.NotNil(t, err, s)
+	}
+}
@@ -0,0 +1,432 @@
+package dao
+
+/*
+author:heqimin
+purpose:pg连接池管理，按dsn懒加载连接，定时检查空闲连接池并回收
+*/
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"pg-adapter/app/config"
+	applog "pg-adapter/app/logger"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errPoolClosed = errors.New("pg pool closed")
+
+// evictAlways 无条件回收
+func evictAlways(*pgPool) bool {
+	return true
+}
+
+/**
+ * @Description: 连接池大小限制
+ */
+type poolLimits struct {
+	maxIdle     int           // 最大空闲连接数
+	maxOpen     int           // 最大连接数，0为不限制
+	maxLifetime time.Duration // 连接最长存活时间，0为不限制
+}
+
+/**
+ * @Description: 获取任务的连接池限制，DbCfg.TaskConns中未配置的项取全局配置
+ * @param taskName
+ * @return poolLimits
+ */
+func taskPoolLimits(taskName string) poolLimits {
+	dbCfg := config.DBCfg()
+	l := defaultPoolLimits()
+	if tc, ok := dbCfg.TaskConns[taskName]; ok {
+		if tc.MaxIdleConns > 0 {
+			l.maxIdle = tc.MaxIdleConns
+		}
+		if tc.MaxOpenConns > 0 {
+			l.maxOpen = tc.MaxOpenConns
+		}
+		if tc.ConnMaxLifetime > 0 {
+			l.maxLifetime = tc.ConnMaxLifetime * time.Second
+		}
+	}
+	return l
+}
+
+// defaultPoolLimits 全局的连接池限制，用于配置表所在库及未单独配置的任务
+func defaultPoolLimits() poolLimits {
+	dbCfg := config.DBCfg()
+	return poolLimits{
+		maxIdle:     dbCfg.MaxIdleConns,
+		maxOpen:     dbCfg.MaxOpenConns,
+		maxLifetime: dbCfg.ConnMaxLifetime * time.Second,
+	}
+}
+
+/**
+ * @Description: 合并共用同一dsn的任务的限制，取较大者
+ * @receiver l
+ * @param o
+ * @return poolLimits
+ */
+func (l poolLimits) merge(o poolLimits) poolLimits {
+	if o.maxIdle > l.maxIdle {
+		l.maxIdle = o.maxIdle
+	}
+	if l.maxOpen != 0 && (o.maxOpen == 0 || o.maxOpen > l.maxOpen) {
+		l.maxOpen = o.maxOpen
+	}
+	if l.maxLifetime != 0 && (o.maxLifetime == 0 || o.maxLifetime > l.maxLifetime) {
+		l.maxLifetime = o.maxLifetime
+	}
+	return l
+}
+
+/**
+ * @Description: 单个dsn的连接池，第一次使用时建立连接
+ */
+type pgPool struct {
+	dsn       string
+	isDefault bool // 配置表所在库，不回收
+
+	mu       sync.Mutex // 保护以下字段及连接的建立
+	db       *gorm.DB
+	limits   *poolLimits
+	closed   bool
+	lastUsed int64 // 最后一次获取连接的时间，unix纳秒，原子读写
+}
+
+/**
+ * @Description: 获取连接，未连接时建立连接，并按limits扩大连接池限制
+ * @receiver p
+ * @param limits
+ * @return *gorm.DB
+ * @return error
+ */
+func (p *pgPool) conn(limits poolLimits) (*gorm.DB, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	if p.db == nil {
+		db, err := makePgConn(p.dsn, limits)
+		if err != nil {
+			// 不缓存失败的连接，下次使用时重试
+			return nil, err
+		}
+		p.db, p.limits = db, &limits
+	} else if merged := p.limits.merge(limits); merged != *p.limits {
+		if d, err := p.db.DB(); err == nil {
+			d.SetMaxIdleConns(merged.maxIdle)
+			d.SetMaxOpenConns(merged.maxOpen)
+			d.SetConnMaxLifetime(merged.maxLifetime)
+		}
+		p.limits = &merged
+	}
+	atomic.StoreInt64(&p.lastUsed, time.Now().UnixNano())
+	return p.db, nil
+}
+
+// sqlDB 已建立的连接，未连接或已回收时返回nil
+func (p *pgPool) sqlDB() *gorm.DB {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil
+	}
+	return p.db
+}
+
+func (p *pgPool) lastUsedTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastUsed))
+}
+
+/**
+ * @Description: 连接池注册表，以dsn为key管理所有pg连接池，并发安全
+ */
+type connRegistry struct {
+	mu     sync.RWMutex
+	pools  map[string]*pgPool
+	failed map[string]string // 连接或检查失败的dsn=>失败原因，重新连接成功后清除
+	stop   chan struct{}
+}
+
+var conns = &connRegistry{pools: make(map[string]*pgPool), failed: make(map[string]string), stop: make(chan struct{})}
+
+/**
+ * @Description: 按dsn获取连接，不存在时建立
+ * @receiver r
+ * @param dsn
+ * @param limits 使用该连接的任务的连接池限制
+ * @return *gorm.DB
+ * @return error
+ */
+func (r *connRegistry) get(dsn string, limits poolLimits) (*gorm.DB, error) {
+	for {
+		r.mu.RLock()
+		p, ok := r.pools[dsn]
+		r.mu.RUnlock()
+		if !ok {
+			r.mu.Lock()
+			if p, ok = r.pools[dsn]; !ok {
+				p = &pgPool{dsn: dsn}
+				r.pools[dsn] = p
+			}
+			r.mu.Unlock()
+		}
+		db, err := p.conn(limits)
+		if err == errPoolClosed {
+			// 获取期间连接池被回收，重新获取
+			continue
+		}
+		if err != nil {
+			r.setFailure(dsn, err)
+		} else {
+			r.clearFailure(dsn)
+		}
+		return db, err
+	}
+}
+
+/**
+ * @Description: 获取已注册的连接池，不建立连接
+ * @receiver r
+ * @param dsn
+ * @return *pgPool 不存在时为nil
+ */
+func (r *connRegistry) lookup(dsn string) *pgPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pools[dsn]
+}
+
+/**
+ * @Description: 记录dsn连接或检查失败的原因，用于就绪检查中报告已回收的连接池
+ * @receiver r
+ * @param dsn
+ * @param err
+ */
+func (r *connRegistry) setFailure(dsn string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed[dsn] = err.Error()
+}
+
+func (r *connRegistry) clearFailure(dsn string) {
+	r.mu.RLock()
+	_, ok := r.failed[dsn]
+	r.mu.RUnlock()
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.failed, dsn)
+}
+
+/**
+ * @Description: 获取dsn最近一次连接或检查失败的原因
+ * @receiver r
+ * @param dsn
+ * @return string
+ * @return bool 没有失败记录时为false
+ */
+func (r *connRegistry) failure(dsn string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	msg, ok := r.failed[dsn]
+	return msg, ok
+}
+
+/**
+ * @Description: 注册配置表所在库的连接，该连接不回收
+ * @receiver r
+ * @param dsn
+ * @param db
+ */
+func (r *connRegistry) setDefault(dsn string, db *gorm.DB) {
+	p := &pgPool{dsn: dsn, isDefault: true, db: db}
+	atomic.StoreInt64(&p.lastUsed, time.Now().UnixNano())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pools[dsn] = p
+}
+
+/**
+ * @Description: 获取所有已建立连接的连接池
+ * @receiver r
+ * @return []*pgPool 按dsn排序
+ */
+func (r *connRegistry) list() []*pgPool {
+	r.mu.RLock()
+	ps := make([]*pgPool, 0, len(r.pools))
+	for _, p := range r.pools {
+		ps = append(ps, p)
+	}
+	r.mu.RUnlock()
+	connected := ps[:0]
+	for _, p := range ps {
+		if p.sqlDB() != nil {
+			connected = append(connected, p)
+		}
+	}
+	sort.Slice(connected, func(i, j int) bool {
+		return connected[i].dsn < connected[j].dsn
+	})
+	return connected
+}
+
+/**
+ * @Description: 回收连接池，cond在加锁后再次判断，为false时不回收
+ * @receiver r
+ * @param p
+ * @param cond
+ * @return bool 是否回收
+ */
+func (r *connRegistry) evict(p *pgPool, cond func(p *pgPool) bool) bool {
+	p.mu.Lock()
+	if p.closed || p.isDefault || !cond(p) {
+		p.mu.Unlock()
+		return false
+	}
+	p.closed = true
+	db := p.db
+	p.mu.Unlock()
+	r.mu.Lock()
+	if r.pools[p.dsn] == p {
+		delete(r.pools, p.dsn)
+	}
+	r.mu.Unlock()
+	if db != nil {
+		// Close会等待正在执行的sql结束
+		if d, err := db.DB(); err == nil {
+			_ = d.Close()
+		}
+	}
+	return true
+}
+
+/**
+ * @Description: 回收不再被任何任务使用的连接池（任务删除或连接信息修改后）
+ * @receiver r
+ * @param inUse 仍在使用的dsn
+ */
+func (r *connRegistry) retain(inUse map[string]bool) {
+	r.mu.RLock()
+	ps := make([]*pgPool, 0, len(r.pools))
+	for dsn, p := range r.pools {
+		if !inUse[dsn] {
+			ps = append(ps, p)
+		}
+	}
+	r.mu.RUnlock()
+	for _, p := range ps {
+		if r.evict(p, evictAlways) {
+			applog.Info("pg pool closed for removed task", "dsn", redactDSN(p.dsn))
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for dsn := range r.failed {
+		if !inUse[dsn] {
+			delete(r.failed, dsn)
+		}
+	}
+}
+
+/**
+ * @Description: 检查所有连接池：空闲超过idleTimeout的回收，其余空闲的连接池ping失败时回收，下次使用时重新连接
+ * @Description: ping失败时只回收检查开始后未被获取且没有正在执行的sql的连接池，避免关闭handle刚获取的连接
+ * @receiver r
+ * @param idleTimeout 为0时不按空闲时间回收
+ * @param pingTimeout
+ */
+func (r *connRegistry) check(idleTimeout time.Duration, pingTimeout time.Duration) {
+	for _, p := range r.list() {
+		begin := time.Now()
+		db := p.sqlDB()
+		if db == nil {
+			continue
+		}
+		d, err := db.DB()
+		if err != nil || d.Stats().InUse > 0 {
+			continue
+		}
+		idle := func(p *pgPool) bool {
+			return idleTimeout > 0 && time.Since(p.lastUsedTime()) > idleTimeout
+		}
+		if idle(p) && r.evict(p, idle) {
+			applog.Info("idle pg pool closed", "dsn", redactDSN(p.dsn), "last_used", p.lastUsedTime())
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err = d.PingContext(ctx)
+		cancel()
+		if err == nil {
+			continue
+		}
+		applog.Warn("pg pool health check failed", "dsn", redactDSN(p.dsn), "error", err)
+		r.setFailure(p.dsn, err)
+		unused := func(p *pgPool) bool {
+			return !p.lastUsedTime().After(begin) && d.Stats().InUse == 0
+		}
+		if !r.evict(p, unused) {
+			applog.Info("pg pool in use, not closed after failed health check", "dsn", redactDSN(p.dsn))
+		}
+	}
+}
+
+/**
+ * @Description: 按DbCfg.PoolCheckInterval定时检查连接池，间隔为0时不检查
+ * @receiver r
+ */
+func (r *connRegistry) janitor() {
+	dbCfg := config.DBCfg()
+	interval := dbCfg.PoolCheckInterval * time.Second
+	if interval <= 0 {
+		return
+	}
+	pingTimeout := dbCfg.PingTimeout * time.Millisecond
+	if pingTimeout <= 0 {
+		pingTimeout = defaultPingTimeout
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.check(dbCfg.PoolIdleTimeout*time.Second, pingTimeout)
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * @Description: 停止检查并关闭所有连接池
+ * @receiver r
+ */
+func (r *connRegistry) closeAll() {
+	close(r.stop)
+	r.mu.Lock()
+	ps := r.pools
+	r.pools = make(map[string]*pgPool)
+	r.mu.Unlock()
+	for _, p := range ps {
+		p.mu.Lock()
+		p.closed = true
+		db := p.db
+		p.mu.Unlock()
+		if db == nil {
+			continue
+		}
+		if d, err := db.DB(); err == nil {
+			_ = d.Close()
+		}
+	}
+}
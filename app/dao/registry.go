@@ -0,0 +1,317 @@
+package dao
+
+/*
+author:heqimin
+purpose:财务数据配置表的内存缓存，启动时加载，定时或手动刷新
+*/
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"pg-adapter/app/config"
+	applog "pg-adapter/app/logger"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type (
+	// taskMeta 任务信息，对应taskitems
+	taskMeta struct {
+		cron string     // 定时导出时间
+		info pgConnInfo // 任务所在pg库连接信息
+		err  error      // 连接信息错误（如密码引用解析失败），使用该任务时返回
+	}
+
+	// finMeta 财务文件信息，对应tableinfo及basicinfo
+	finMeta struct {
+		taskName string   // 所属任务名
+		schema   string   // 所属库名
+		sqls     procSQLs // 五种导出sql
+	}
+
+	// fieldMeta 字段信息，对应cj_index
+	fieldMeta struct {
+		name  string   // 字段名
+		fins  []string // 所属财务文件
+		fType string   // 字段类型
+	}
+
+	// metaSnapshot 配置表某一时刻的完整内容，加载完成后只读，刷新时整体替换
+	metaSnapshot struct {
+		tasks      map[string]taskMeta // 任务名=>任务信息，仅export = 2
+		fins       map[string]finMeta  // 财务文件名=>财务文件信息，仅isvalid = 2
+		taskFins   map[string][]string // 任务名=>财务文件名
+		fields     map[int]fieldMeta   // dmno=>字段信息
+		fieldTypes map[string]string   // 小写字段名=>类型，不含已废弃及301之前的字段
+		cron       CronTask            // 由任务信息生成的定时任务
+		loadTime   time.Time
+	}
+
+	// MetaSummary 配置缓存概况
+	MetaSummary struct {
+		LoadTime time.Time `json:"load_time"`
+		Tasks    int       `json:"tasks"`
+		Fins     int       `json:"fins"`
+		Fields   int       `json:"fields"`
+	}
+)
+
+var (
+	meta     atomic.Value       // *metaSnapshot
+	metaStop = make(chan bool) // 停止定时刷新
+)
+
+/**
+ * @Description: 获取当前配置缓存
+ * @return *metaSnapshot
+ */
+func getMeta() *metaSnapshot {
+	m, _ := meta.Load().(*metaSnapshot)
+	if m == nil {
+		return &metaSnapshot{}
+	}
+	return m
+}
+
+/*ReloadMeta
+ * @Description: 重新加载所有配置表，全部加载成功后替换缓存（任务连接信息及定时任务随之更新），失败时保留原缓存
+ * @Description: 替换后关闭已不再被任何任务使用的pg连接
+ * @return error
+ */
+func ReloadMeta() error {
+	m, err := loadMeta()
+	if err != nil {
+		return err
+	}
+	old := getMeta()
+	meta.Store(m)
+	logTaskChanges(old, m)
+	closeStalePools(m)
+	return nil
+}
+
+/**
+ * @Description: 记录刷新前后任务的增删
+ * @param old
+ * @param m
+ */
+func logTaskChanges(old *metaSnapshot, m *metaSnapshot) {
+	if old.tasks == nil {
+		return
+	}
+	for taskName := range m.tasks {
+		if _, ok := old.tasks[taskName]; !ok {
+			applog.Info("task added", "task", taskName)
+		}
+	}
+	for taskName := range old.tasks {
+		if _, ok := m.tasks[taskName]; !ok {
+			applog.Info("task removed", "task", taskName)
+		}
+	}
+}
+
+/*Meta
+ * @Description: 获取配置缓存概况
+ * @return MetaSummary
+ */
+func Meta() MetaSummary {
+	m := getMeta()
+	return MetaSummary{LoadTime: m.loadTime, Tasks: len(m.tasks), Fins: len(m.fins), Fields: len(m.fields)}
+}
+
+/*HasTask
+ * @Description: 判断任务是否存在（仅export = 2的任务）
+ * @param taskName
+ * @return bool
+ */
+func HasTask(taskName string) bool {
+	_, ok := getMeta().tasks[taskName]
+	return ok
+}
+
+/**
+ * @Description: 按配置的时间间隔定时刷新配置缓存，间隔为0时不刷新
+ */
+func metaRefresh() {
+	interval := config.Tables().RefreshInterval * time.Second
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ReloadMeta(); err != nil {
+					applog.Error("reload meta failed", "error", err)
+				}
+			case <-metaStop:
+				return
+			}
+		}
+	}()
+}
+
+/**
+ * @Description: 从配置库加载所有配置表
+ * @return m
+ * @return err
+ */
+func loadMeta() (m *metaSnapshot, err error) {
+	m = &metaSnapshot{
+		tasks:      make(map[string]taskMeta),
+		fins:       make(map[string]finMeta),
+		taskFins:   make(map[string][]string),
+		fields:     make(map[int]fieldMeta),
+		fieldTypes: make(map[string]string),
+		cron:       make(CronTask),
+		loadTime:   time.Now(),
+	}
+	if err = m.loadTasks(); err != nil {
+		return nil, errors.Wrap(err, "load "+tables.taskInfo)
+	}
+	if err = m.loadFins(); err != nil {
+		return nil, errors.Wrap(err, "load "+tables.finInfo)
+	}
+	if err = m.loadSchemas(); err != nil {
+		return nil, errors.Wrap(err, "load "+tables.fin2table)
+	}
+	if err = m.loadFields(); err != nil {
+		return nil, errors.Wrap(err, "load "+tables.fieldInfo)
+	}
+	return m, nil
+}
+
+func (m *metaSnapshot) loadTasks() error {
+	querySql := fmt.Sprintf("SELECT taskname,cron,server,username,passwd,database from %s.%s where export = 2;",
+		tables.schemaName, tables.taskInfo)
+	rows, err := finDB.Raw(querySql).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var taskName, cron, server, username, passwd, database string
+		if err = rows.Scan(&taskName, &cron, &server, &username, &passwd, &database); err != nil {
+			return err
+		}
+		info := getInfo(server, username, passwd, database)
+		info.opts = taskConnOptions(taskName)
+		task := taskMeta{cron: cron, info: info}
+		// 密码可为密钥引用，每次刷新时重新解析，密钥变更后dsn随之变化并使用新的连接
+		if task.info.passwd, task.err = resolveSecret(passwd); task.err != nil {
+			applog.Error("resolve task password failed", "task", taskName, "error", task.err)
+			task.err = errors.Wrapf(task.err, "task %s", taskName)
+		}
+		m.tasks[taskName] = task
+		m.cron.AppendCron(taskName, cron)
+	}
+	return rows.Err()
+}
+
+func (m *metaSnapshot) loadFins() error {
+	// 仅限自营，isvalid=2
+	querySql := fmt.Sprintf("SELECT finname,taskname,allproc,repproc,finproc,realproc,codeproc from %s.%s where isvalid = 2;",
+		tables.schemaName, tables.finInfo)
+	rows, err := finDB.Raw(querySql).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var finName, taskName string
+		var sqls [5]sql.NullString
+		err = rows.Scan(&finName, &taskName, &sqls[opAll], &sqls[opBbrq], &sqls[opRtime], &sqls[opReal], &sqls[opCode])
+		if err != nil {
+			return err
+		}
+		fm := finMeta{taskName: taskName}
+		for i := range sqls {
+			fm.sqls[i] = sqls[i].String
+		}
+		m.fins[finName] = fm
+		m.taskFins[taskName] = append(m.taskFins[taskName], finName)
+	}
+	return rows.Err()
+}
+
+func (m *metaSnapshot) loadSchemas() error {
+	querySql := fmt.Sprintf("SELECT distinct finname,schema from %s.%s;",
+		tables.schemaName, tables.fin2table)
+	rows, err := finDB.Raw(querySql).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var finName, schemaName string
+		if err = rows.Scan(&finName, &schemaName); err != nil {
+			return err
+		}
+		// 一个财务文件对应多个库时取第一个
+		if fm, ok := m.fins[finName]; ok && fm.schema == "" {
+			fm.schema = schemaName
+			m.fins[finName] = fm
+		}
+	}
+	return rows.Err()
+}
+
+func (m *metaSnapshot) loadFields() error {
+	querySql := fmt.Sprintf("SELECT dmno,cj_field,cj_table,cj_type from %s.%s;",
+		tables.schemaName, tables.fieldInfo)
+	rows, err := finDB.Raw(querySql).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var dmno int
+		var fieldName, finNames, fType sql.NullString
+		if err = rows.Scan(&dmno, &fieldName, &finNames, &fType); err != nil {
+			return err
+		}
+		if !fieldName.Valid {
+			continue
+		}
+		fm := fieldMeta{name: fieldName.String, fType: fType.String}
+		if finNames.Valid {
+			fm.fins = strings.Split(finNames.String, ";")
+		}
+		m.fields[dmno] = fm
+		// 301 是财务数据的起始字段，且301特殊处理；配置表中字段名有大写，统一转换成小写
+		if dmno > 301 && !strings.Contains(finNames.String, "已废弃") {
+			m.fieldTypes[strings.ToLower(fieldName.String)] = fType.String
+		}
+	}
+	return rows.Err()
+}
+
+/**
+ * @Description: 解析以逗号隔开的字段id
+ * @param datatype
+ * @return ids
+ * @return err
+ */
+func parseDataTypes(datatype string) (ids []int, err error) {
+	for _, s := range strings.Split(datatype, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		id, e := strconv.Atoi(s)
+		if e != nil {
+			return nil, fmt.Errorf("error datatype param: %q is not a field id", s)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		err = errors.New("no datatype please check!")
+	}
+	return
+}
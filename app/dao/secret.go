@@ -0,0 +1,54 @@
+package dao
+
+/*
+author:heqimin
+purpose:解析pg连接信息中的密钥引用
+*/
+
+import (
+	"context"
+	"pg-adapter/app/secret"
+	"regexp"
+	"time"
+)
+
+// 解析单个密钥引用的超时时间
+const secretTimeout = 5 * time.Second
+
+/**
+ * @Description: 解析密钥引用（dapr:/env:/file:），非引用原样返回
+ * @param v
+ * @return string
+ * @return error
+ */
+func resolveSecret(v string) (string, error) {
+	if !secret.IsRef(v) {
+		return v, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	return secret.Resolve(ctx, v)
+}
+
+var dsnPasswordPattern = regexp.MustCompile(`(^|\s)password=(\S+)`)
+
+/**
+ * @Description: 解析dsn中的密钥引用，整个dsn为引用时解析整个dsn，否则解析其中的password
+ * @param dsn
+ * @return string
+ * @return error
+ */
+func resolveDSN(dsn string) (string, error) {
+	if secret.IsRef(dsn) {
+		return resolveSecret(dsn)
+	}
+	m := dsnPasswordPattern.FindStringSubmatchIndex(dsn)
+	if m == nil || !secret.IsRef(dsn[m[4]:m[5]]) {
+		return dsn, nil
+	}
+	passwd, err := resolveSecret(dsn[m[4]:m[5]])
+	if err != nil {
+		return "", err
+	}
+	return dsn[:m[4]] + dsnValue(passwd) + dsn[m[5]:], nil
+}
@@ -0,0 +1,159 @@
+package dao
+
+/*
+author:heqimin
+purpose:最新值快照，每个代码的每个字段返回指定日期及之前最新的非空值
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// snapshotStart 快照请求的起始日期，即不限制开始日期
+const snapshotStart = 19000101
+
+/**
+ * @Description: 解析快照日期
+ * @param s YYYYMMDD，为空时不使用快照
+ * @return date
+ * @return err
+ */
+func parseSnapshot(s string) (date int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if date, err = strconv.Atoi(s); err != nil || !isDate(date) {
+		return 0, fmt.Errorf("error snapshot param: %q, should be YYYYMMDD", s)
+	}
+	return date, nil
+}
+
+/**
+ * @Description: 设置快照日期，快照时起止日期为不限制到快照日期
+ * @receiver p
+ * @param date
+ */
+func (p *queryPara) setSnapshot(date int) {
+	p.snapshot = date
+	p.startdate, p.enddate = snapshotStart, date
+}
+
+/**
+ * @Description: 在sql中按市场代码聚合为一条：每个字段取最新（按bbrq、rtime）的非空值，bbrq、rtime取最新一行的
+ * @Description: bbrq或rtime为空的排在最后，快照日期之后的数据不参与
+ * @param unionSql 各市场的select，不含结尾的;
+ * @param cols 所取字段
+ * @param datePh 快照日期（YYYYMMDD字符串）的绑定参数占位符
+ * @return string
+ */
+func snapshotSql(unionSql string, cols []string, datePh string) string {
+	order := fmt.Sprintf("order by %s desc nulls last,%s desc nulls last", BBRQ, RTIME)
+	aggs := []string{
+		fmt.Sprintf("(array_agg(%[1]s %[2]s))[1] as %[1]s", BBRQ, order),
+		fmt.Sprintf("(array_agg(%[1]s %[2]s))[1] as %[1]s", RTIME, order),
+	}
+	for _, col := range cols {
+		aggs = append(aggs, fmt.Sprintf("(array_agg(%[1]s %[2]s) filter (where %[1]s is not null))[1] as %[1]s", col, order))
+	}
+	return fmt.Sprintf("select %[1]s,%[2]s,%[3]s from (%[4]s) s where to_char(%[5]s,'YYYYMMDD') <= %[6]s group by %[2]s,%[1]s order by %[2]s,%[1]s",
+		ZQDM, MARKET, strings.Join(aggs, ","), unionSql, BBRQ, datePh)
+}
+
+/**
+ * @Description: 判断a是否比b新：先比较datetime，再比较src-time
+ * @param a
+ * @param b
+ * @return bool
+ */
+func newerThan(a *DateValue, b *DateValue) bool {
+	if a.DateTime != b.DateTime {
+		return a.DateTime > b.DateTime
+	}
+	return a.SrcTime > b.SrcTime
+}
+
+/**
+ * @Description: 逐行将每个(market, code)的数据聚合为一条快照，不缓存结果
+ * @Description: 每个字段取最新（按datetime、src-time）的非空值，datetime、src-time取最新一行的；同一代码的数据需在结果中相邻
+ */
+type snapshotPicker struct {
+	code   string
+	dv     DateValue
+	fields map[string]DateValue // 字段名=>字段值所在数据的datetime及src-time
+	has    bool                 // 是否有未输出的快照
+	emit   func(code string, dv DateValue) error
+}
+
+/**
+ * @Description: 处理一行：代码与上一行不同时输出上一个代码的快照
+ * @receiver p
+ * @param code
+ * @param dv
+ * @return error
+ */
+func (p *snapshotPicker) add(code string, dv DateValue) error {
+	if p.has && (code != p.code || dv.Market != p.dv.Market) {
+		if err := p.flush(); err != nil {
+			return err
+		}
+	}
+	pos := DateValue{DateTime: dv.DateTime, SrcTime: dv.SrcTime}
+	if !p.has {
+		p.code, p.has = code, true
+		p.dv = DateValue{Market: dv.Market, DateTime: dv.DateTime, SrcTime: dv.SrcTime, Value: make(RowValue, len(dv.Value))}
+		p.fields = make(map[string]DateValue, len(dv.Value))
+	} else if newerThan(&pos, &p.dv) {
+		p.dv.DateTime, p.dv.SrcTime = dv.DateTime, dv.SrcTime
+	}
+	for field, v := range dv.Value {
+		if v == nil {
+			if _, ok := p.dv.Value[field]; !ok {
+				p.dv.Value[field] = nil
+			}
+			continue
+		}
+		if old, ok := p.fields[field]; ok && !newerThan(&pos, &old) {
+			continue
+		}
+		p.dv.Value[field] = v
+		p.fields[field] = pos
+	}
+	return nil
+}
+
+/**
+ * @Description: 输出最后一个代码的快照
+ * @receiver p
+ * @return error
+ */
+func (p *snapshotPicker) flush() error {
+	if !p.has {
+		return nil
+	}
+	p.has = false
+	return p.emit(p.code, p.dv)
+}
+
+/**
+ * @Description: 存储过程结果的快照，sql的结果已由snapshotSql聚合，不经过此处
+ * @Description: 逐行处理，跳过快照日期之后的数据；时点查询时只在asof可见的版本中取最新；存储过程需按市场、代码输出，同一代码的数据相邻
+ * @receiver cp
+ * @param emit
+ * @return error
+ */
+func (cp *colsProc) snapshotEach(emit func(code string, dv DateValue) error) error {
+	p := &snapshotPicker{emit: emit}
+	err := cp.rowsEach(func(code string, dv DateValue) error {
+		if dv.DateTime > cp.snapshot {
+			return nil
+		}
+		return p.add(code, dv)
+	})
+	if err != nil {
+		return err
+	}
+	return p.flush()
+}
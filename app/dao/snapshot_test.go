@@ -0,0 +1,36 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotPicker(t *testing.T) {
+	dv := func(market string, datetime int, srcTime string, v RowValue) DateValue {
+		return DateValue{Market: market, DateTime: datetime, SrcTime: srcTime, Value: v}
+	}
+	var got []DateValue
+	p := &snapshotPicker{emit: func(code string, dv DateValue) error {
+		got = append(got, dv)
+		return nil
+	}}
+	rows := []struct {
+		code string
+		dv   DateValue
+	}{
+		{"600000", dv("17", 20210802, "2021-08-02 09:00:00.000000", RowValue{"f1": 1.0, "f2": "a", "f3": nil})},
+		{"600000", dv("17", 20210803, "2021-08-03 09:00:00.000000", RowValue{"f1": nil, "f2": "b", "f3": nil})},
+		{"600000", dv("17", 20210803, "2021-08-03 08:00:00.000000", RowValue{"f1": 3.0, "f2": "c", "f3": nil})},
+		{"300033", dv("33", 20210801, "", RowValue{"f1": 4.0, "f2": nil, "f3": nil})},
+	}
+	for _, r := range rows {
+		assert.Nil(t, p.add(r.code, r.dv))
+	}
+	assert.Nil(t, p.flush())
+	// 每个字段取最新的非空值，全为空时仍返回该字段
+	assert.Equal(t, []DateValue{
+		dv("17", 20210803, "2021-08-03 09:00:00.000000", RowValue{"f1": 3.0, "f2": "b", "f3": nil}),
+		dv("33", 20210801, "", RowValue{"f1": 4.0, "f2": nil, "f3": nil}),
+	}, got)
+}
@@ -0,0 +1,127 @@
+package dao
+
+/*
+author:heqimin
+purpose:财务文件sql渲染，请求参数不直接拼接进sql
+*/
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 老版sql中的占位符
+const (
+	phStart    = "[start]"    // 开始日期
+	phEnd      = "[end]"      // 截止日期
+	phCodelist = "[codelist]" // 代码列表
+)
+
+/**
+ * @Description: 渲染老版sql占位符所用的参数，为空的占位符不替换
+ */
+type sqlParams struct {
+	start int      // 开始日期 YYYYMMDD，0为不替换
+	end   int      // 截止日期 YYYYMMDD，0为不替换
+	codes []string // 代码，nil为不替换
+}
+
+/**
+ * @Description: sql绑定参数，按顺序生成 $1,$2... 占位符
+ */
+type sqlArgs []interface{}
+
+/**
+ * @Description: 添加绑定参数并返回其占位符
+ * @receiver a
+ * @param v
+ * @return string
+ */
+func (a *sqlArgs) bind(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+/**
+ * @Description: 替换配置表中sql的 [start] [end] [codelist] 占位符
+ * @Description: 占位符可能出现在引号内或存储过程参数中，无法改为绑定参数，因此先严格校验再以字面量替换：
+ * @Description: 日期必须为合法的YYYYMMDD整数，代码必须匹配codePattern并以单引号包围
+ * @param tpl 配置表中的sql
+ * @param p
+ * @return string
+ * @return error
+ */
+func renderTemplate(tpl string, p sqlParams) (string, error) {
+	sql := tpl
+	for _, d := range []struct {
+		ph   string
+		date int
+	}{{phStart, p.start}, {phEnd, p.end}} {
+		if d.date == 0 || !strings.Contains(sql, d.ph) {
+			continue
+		}
+		if !isDate(d.date) {
+			return "", fmt.Errorf("invalid date %d, should be YYYYMMDD", d.date)
+		}
+		sql = strings.Replace(sql, d.ph, strconv.Itoa(d.date), -1)
+	}
+	if p.codes != nil && strings.Contains(sql, phCodelist) {
+		literals, err := codeLiterals(p.codes)
+		if err != nil {
+			return "", err
+		}
+		sql = strings.Replace(sql, phCodelist, literals, -1)
+	}
+	return sql, nil
+}
+
+/**
+ * @Description: 将代码转化为sql字面量列表
+ * @param codes
+ * @return string 示例：'300033','300093'
+ * @return error
+ */
+func codeLiterals(codes []string) (string, error) {
+	if len(codes) == 0 {
+		return "", fmt.Errorf("empty codelist")
+	}
+	literals := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if !codePattern.MatchString(code) {
+			return "", fmt.Errorf("invalid code %q", code)
+		}
+		literals = append(literals, "'"+code+"'")
+	}
+	return strings.Join(literals, ","), nil
+}
+
+/**
+ * @Description: 拆分以逗号隔开的代码并校验
+ * @param codelist 示例：300033,300093
+ * @return []string
+ * @return error
+ */
+func splitCodes(codelist string) ([]string, error) {
+	codes := make([]string, 0)
+	for _, code := range strings.Split(codelist, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		if !codePattern.MatchString(code) {
+			return nil, fmt.Errorf("invalid code %q", code)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+/**
+ * @Description: pg标识符加双引号转义，用于存储过程返回的游标名
+ * @param name
+ * @return string
+ */
+func quoteIdent(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
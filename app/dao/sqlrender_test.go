@@ -0,0 +1,138 @@
+package dao
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 代码参数中的注入尝试，均应被拒绝
+var injectionCodes = []string{
+	"300033'",
+	"300033' or '1'='1",
+	"1');drop table taskitems;--",
+	"300033;select 1",
+	"300033 --",
+	"$1",
+	"300033\n;",
+	"/*x*/",
+	`300033"`,
+	"(300033)",
+}
+
+func TestRenderTemplate(t *testing.T) {
+	cases := []struct {
+		name    string
+		tpl     string
+		p       sqlParams
+		want    string
+		wantErr bool
+	}{
+		{"dates", "select * from t where bbrq between [start] and [end]", sqlParams{start: 20210803, end: 20210804},
+			"select * from t where bbrq between 20210803 and 20210804", false},
+		{"repeated", "call p('[start]','[start]')", sqlParams{start: 20210803}, "call p('20210803','20210803')", false},
+		{"zero not replaced", "select [start],[end]", sqlParams{end: 20210804}, "select [start],20210804", false},
+		{"no placeholder", "select 1", sqlParams{start: 20211399}, "select 1", false},
+		{"invalid date", "select [start]", sqlParams{start: 20211399}, "", true},
+		{"codes", "select * from t where zqdm in ([codelist])", sqlParams{codes: []string{"300033", "SH.600000"}},
+			"select * from t where zqdm in ('300033','SH.600000')", false},
+		{"nil codes not replaced", "select [codelist]", sqlParams{}, "select [codelist]", false},
+		{"empty codes", "select [codelist]", sqlParams{codes: []string{}}, "", true},
+	}
+	for _, c := range cases {
+		sql, err := renderTemplate(c.tpl, c.p)
+		if c.wantErr {
+			assert.NotNil(t, err, c.name)
+			continue
+		}
+		assert.Nil(t, err, c.name)
+		assert.Equal(t, c.want, sql, c.name)
+	}
+	for _, code := range injectionCodes {
+		_, err := renderTemplate("select * from t where zqdm in ([codelist])", sqlParams{codes: []string{"300033", code}})
+		assert.NotNil(t, err, code)
+	}
+}
+
+func TestCodeLiterals(t *testing.T) {
+	s, err := codeLiterals([]string{"300033", "a-b_c.d"})
+	assert.Nil(t, err)
+	assert.Equal(t, "'300033','a-b_c.d'", s)
+	_, err = codeLiterals(nil)
+	assert.NotNil(t, err)
+	for _, code := range append(injectionCodes, "") {
+		_, err = codeLiterals([]string{code})
+		assert.NotNil(t, err, code)
+	}
+}
+
+func TestSplitCodes(t *testing.T) {
+	cases := []struct {
+		codelist string
+		want     []string
+		wantErr  bool
+	}{
+		{"", []string{}, false},
+		{"300033", []string{"300033"}, false},
+		{" 300033 , 300093,", []string{"300033", "300093"}, false},
+		{",,", []string{}, false},
+		{"300033,300093'", nil, true},
+		{"300033' or '1'='1", nil, true},
+		{"1');drop table taskitems;--", nil, true},
+		{"300033 300093", nil, true},
+	}
+	for _, c := range cases {
+		codes, err := splitCodes(c.codelist)
+		if c.wantErr {
+			assert.NotNil(t, err, c.codelist)
+			continue
+		}
+		assert.Nil(t, err, c.codelist)
+		assert.Equal(t, c.want, codes, c.codelist)
+	}
+}
+
+func TestSqlOperate(t *testing.T) {
+	const origin = "select * from fin_table where bbrq between 20210803 and 20210804; "
+	q := finQuery{
+		f: finance{finName: "test.fin", dataTypes: []string{"f1", "f2"}},
+		p: queryPara{marketCodes: map[int]string{33: "300033,300093", 17: ""}},
+	}
+	sql, args, err := q.sqlOperate(origin, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "with base as (select * from fin_table where bbrq between 20210803 and 20210804)"+
+		"select zqdm,market,bbrq,rtime,f1,f2 from base where market = $1"+
+		" union select zqdm,market,bbrq,rtime,f1,f2 from base where market = $2 and zqdm = any($3)"+
+		" order by market,zqdm,bbrq,rtime;", sql)
+	assert.Equal(t, sqlArgs{17, 33, []string{"300033", "300093"}}, args)
+
+	// 未要求排序时不加order by
+	sql, _, err = q.sqlOperate(origin, false)
+	assert.Nil(t, err)
+	assert.False(t, strings.Contains(sql, "order by"))
+
+	// 时点查询以绑定参数过滤rtime
+	q.p.asof = "2021-08-03 15:00:00.000000"
+	sql, args, err = q.sqlOperate(origin, false)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(sql, "rtime <= $2"))
+	assert.True(t, strings.Contains(sql, "rtime <= $5"))
+	assert.True(t, strings.HasPrefix(sql, "with base as (select * from fin_table where bbrq between 20210803 and 20210804)select distinct on (market,zqdm,bbrq)"))
+	assert.Equal(t, sqlArgs{17, q.p.asof, 33, []string{"300033", "300093"}, q.p.asof}, args)
+
+	// 快照优先于时点
+	q.p.snapshot = 20210803
+	sql, _, err = q.sqlOperate(origin, true)
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(sql, "bbrq desc nulls last"))
+	assert.True(t, strings.Contains(sql, "filter (where f1 is not null)"))
+	assert.True(t, strings.Contains(sql, "group by market,zqdm"))
+
+	// 代码不合法时报错，不生成sql
+	for _, code := range injectionCodes {
+		q.p.marketCodes = map[int]string{33: "300033," + code}
+		_, _, err = q.sqlOperate(origin, true)
+		assert.NotNil(t, err, code)
+	}
+}
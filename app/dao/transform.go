@@ -9,10 +9,12 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
-	"log"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,9 +34,32 @@ type colsProc struct {
 	sqlHead   string // sql头，replace into
 	sqlFmtStr string // 用于格式化values
 	// 每行数据
-	row *colValue
+	row      *colValue
+	rowCnt   int        // 已读取的行数
+	filter   *rowFilter // 结果过滤，为nil时不过滤
+	ordered  bool       // 结果在sql中已排序
+	snapshot int        // 快照日期，不为0时每个代码的每个字段只保留该日期及之前最新的非空值
+	asof     string     // 时点，不为空时只保留src-time在该时刻及之前的版本
+	proc     bool       // 存储过程的结果，未经sql筛选
+	page     pageOpt    // 分页参数
+	pageIdx  []int      // 分页时排序键在结果中的位置
+	last     pageCursor // 分页时上一行的位置
 }
 
+// codeKey 结果按市场、代码分组的键
+type codeKey struct {
+	market string
+	code   string
+}
+
+// 字段值在json中的类型
+const (
+	kindString = iota // 字符串
+	kindDouble        // 浮点数
+	kindLong          // 整数
+	kindDate          // YYYYMMDD形式的整数日期
+)
+
 /**
  * @Description: 用于逐行处理sql数据的对象
  */
@@ -45,11 +70,27 @@ type colValue struct {
 	// 从pgsql中取出来的数据
 	scans  []interface{} //存储values各项地址，用于进行scan操作
 	values []sql.RawBytes
+	kinds  []int  // 各字段值在json中的类型
+	skip   []bool // 不需要输出的字段
 
 	// 组装入库mysql的数据时
 	colsScans []interface{} //存储每行的各个字段值，解构[]interface{}进行format
 }
 
+/**
+ * @Description: 对RecordWriter加锁，多个handle并发写入同一个输出时使用
+ */
+type syncWriter struct {
+	mu sync.Mutex
+	w  RecordWriter
+}
+
+func (s *syncWriter) WriteRecord(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.WriteRecord(r)
+}
+
 /**
  * @Description: pg到mysql数据转换
  * @return error
@@ -65,9 +106,40 @@ func (h *exportHandle) startTransform() ([]CodeValue, error) {
 	}
 	// sql请求结果处理初始化
 	//cp.querySqlInit()
+	defer func() {
+		h.rowCnt = cp.rowCnt
+	}()
 	return cp.sqlRowsHandle()
 }
 
+/**
+ * @Description: pg数据逐行转换并写入w，不在内存中缓存结果
+ * @receiver h
+ * @param schema 财务文件所属库名
+ * @param w
+ * @return error
+ */
+func (h *exportHandle) streamTransform(schema string, w RecordWriter) error {
+	cp, err := h.newColsProc()
+	if err != nil {
+		return err
+	}
+	err = cp.transformPrepare()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		h.rowCnt = cp.rowCnt
+	}()
+	return cp.sqlRowsEmit(func(code string, dv DateValue) error {
+		r := Record{Schema: schema, Code: code, DateValue: dv, fin: h.finName}
+		if cp.page.limit > 0 {
+			r.pos = cp.position(code, dv)
+		}
+		return w.WriteRecord(r)
+	})
+}
+
 /**
  * @Description:创建新的sql请求结果处理对象
  * @param rows
@@ -86,7 +158,7 @@ func (h *exportHandle) newColsProc() (*colsProc, error) {
 		return nil, err
 	}
 	bts := new(bytes.Buffer)
-	return &colsProc{finName: h.finName, rows: h.rows, colNames: colNames, colTypes: colTypes, querySql: bts}, err
+	return &colsProc{finName: h.finName, rows: h.rows, colNames: colNames, colTypes: colTypes, querySql: bts, filter: h.filter, ordered: h.ordered, snapshot: h.snapshot, asof: h.asof, proc: h.funcFlag, page: h.page}, err
 }
 
 /**
@@ -99,49 +171,212 @@ func (cp *colsProc) transformPrepare() (err error) {
 	cp.row = newValue(cp.colNames)
 	cp.row.colTypes = cp.colTypes
 	cp.row.valueInit()
+	cp.row.kinds = valueKinds(cp.colTypes, cp.colNames, getFieldTypes(cp.colNames))
+	cp.row.skip = make([]bool, len(cp.colNames))
+	if cp.filter != nil {
+		for i, col := range cp.colNames {
+			cp.row.skip[i] = !cp.filter.keep(col)
+		}
+	}
+	if cp.page.limit > 0 && !cp.proc {
+		cp.pageIdx = pageColumns(cp.colNames, cp.row.skip)
+	}
 	return
 }
 
 /**
- * @Description: 将querySql做进一步处理
- * @receiver cp
- * @return error
+ * @Description: 确定各字段值在json中的类型
+ * @Description: 字段信息表中错误较多，pg中为数值类型的以pg类型为准（仅用cj_type区分整数与浮点），字符类型的按cj_type转换
+ * @param colTypes
+ * @param colNames
+ * @param fieldTypes 字段名=>cj_type
+ * @return kinds
  */
-func (cp *colsProc) querySqlExec(strSql string, cntFlag int) {
-	// 进来的Sql以,结尾，需要改成;结尾
-	strSql = strings.TrimRight(strSql, ",") + ";"
-	var err error
-	if err != nil {
-		log.Println(err.Error())
+func valueKinds(colTypes []*sql.ColumnType, colNames []string, fieldTypes map[string]string) []int {
+	kinds := make([]int, len(colNames))
+	for i, ct := range colTypes {
+		fType := fieldTypes[colNames[i]]
+		switch ct.DatabaseTypeName() {
+		case "INT2", "INT4", "INT8":
+			kinds[i] = kindLong
+		case "FLOAT4", "FLOAT8", "NUMERIC":
+			kinds[i] = kindDouble
+			if fType == pgTypeLong {
+				kinds[i] = kindLong
+			}
+		default:
+			switch fType {
+			case pgTypeDouble:
+				kinds[i] = kindDouble
+			case pgTypeLong:
+				kinds[i] = kindLong
+			case pgTypeTime:
+				kinds[i] = kindDate
+			default:
+				kinds[i] = kindString
+			}
+		}
+	}
+	return kinds
+}
+
+/**
+ * @Description: 按字段类型转换单个字段值，sql中的NULL为nil，无法转换时保留原字符串
+ * @receiver c
+ * @param i
+ * @return interface{}
+ */
+func (c *colValue) typedValue(i int) interface{} {
+	if c.values[i] == nil {
+		return nil
+	}
+	value := string(c.values[i])
+	trimmed := strings.TrimSpace(value)
+	switch c.kinds[i] {
+	case kindDouble:
+		if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return f
+		}
+	case kindLong:
+		if n, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return n
+		}
+		// numeric带小数位的整数，如 12.00
+		if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+				return int64(f)
+			}
+			return f
+		}
+	case kindDate:
+		if n, err := strconv.Atoi(trimmed); err == nil {
+			return n
+		}
 	}
+	return value
 }
 
 /**
- * @Description: pg请求结果处理
+ * @Description: pg请求结果处理，按(market, code)分组，不依赖sql中行的顺序
+ * @Description: sql未排序时分组后按市场、代码排序，每个代码的数据按datetime、src-time排序
  * @receiver cp
  * @return []CodeValue
  * @return error
  */
 func (cp *colsProc) sqlRowsHandle() ([]CodeValue, error) {
 	cv := make([]CodeValue, 0)
-	dv := make([]DateValue, 0)
-	var lastCode string
-	for cp.rows.Next() {
-		code, r, err := cp.row.sqlRowHandle(cp.rows)
-		if code != lastCode {
-			if lastCode != "" {
-				cv = append(cv, CodeValue{lastCode, dv})
-				dv = make([]DateValue, 0)
+	index := make(map[codeKey]int) // (market, code) => 在cv中的位置
+	err := cp.sqlRowsEmit(func(code string, r DateValue) error {
+		key := codeKey{r.Market, code}
+		i, ok := index[key]
+		if !ok {
+			i = len(cv)
+			index[key] = i
+			cv = append(cv, CodeValue{Code: code, TimeList: make([]DateValue, 0)})
+		}
+		cv[i].TimeList = append(cv[i].TimeList, r)
+		return nil
+	})
+	if err != nil {
+		return []CodeValue{}, err
+	}
+	if !cp.ordered {
+		sortCodeValues(cv)
+	}
+	return cv, nil
+}
+
+/**
+ * @Description: 按市场、代码排序，每个代码的数据按datetime、src-time排序
+ * @param cv 每个CodeValue中的数据属于同一市场
+ */
+func sortCodeValues(cv []CodeValue) {
+	for _, c := range cv {
+		tl := c.TimeList
+		sort.SliceStable(tl, func(i, j int) bool {
+			if tl[i].DateTime != tl[j].DateTime {
+				return tl[i].DateTime < tl[j].DateTime
 			}
-			lastCode = code
+			return tl[i].SrcTime < tl[j].SrcTime
+		})
+	}
+	sort.SliceStable(cv, func(i, j int) bool {
+		// 分组时每个CodeValue至少有一条数据
+		mi, mj := cv[i].TimeList[0].Market, cv[j].TimeList[0].Market
+		if mi != mj {
+			return mi < mj
+		}
+		return cv[i].Code < cv[j].Code
+	})
+}
+
+/**
+ * @Description: pg请求结果逐行处理，每处理完一行调用一次emit，emit返回错误时停止处理
+ * @Description: 快照及时点查询时sql已只返回每个代码的快照、每个代码每个日期的最新版本，存储过程的结果逐行聚合或筛选，均不缓存
+ * @Description: 分页时sql已截取，存储过程的结果跳过已返回的条数并在读取page.limit条后停止
+ * @receiver cp
+ * @param emit
+ * @return error
+ */
+func (cp *colsProc) sqlRowsEmit(emit func(code string, dv DateValue) error) (err error) {
+	defer func() {
+		rowsTotal.Add(float64(cp.rowCnt), cp.finName)
+	}()
+	skip := 0
+	if cp.proc {
+		skip = cp.page.offset()
+	}
+	count := func(code string, dv DateValue) error {
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if cp.page.limit > 0 && cp.rowCnt >= cp.page.limit {
+			return errPageFull
 		}
+		if err := emit(code, dv); err != nil {
+			return err
+		}
+		cp.rowCnt++
+		return nil
+	}
+	switch {
+	case cp.snapshot != 0 && cp.proc:
+		err = cp.snapshotEach(count)
+	case cp.asof != "" && cp.proc:
+		err = cp.asofEach(count)
+	default:
+		err = cp.rowsEach(count)
+	}
+	if err == errPageFull {
+		err = nil
+	}
+	return
+}
+
+/**
+ * @Description: 逐行读取并过滤pg请求结果，时点查询时过滤掉asof之后到达的版本
+ * @receiver cp
+ * @param emit
+ * @return error
+ */
+func (cp *colsProc) rowsEach(emit func(code string, dv DateValue) error) error {
+	for cp.rows.Next() {
+		code, r, err := cp.row.sqlRowHandle(cp.rows)
 		if err != nil {
-			return []CodeValue{}, err
+			return err
+		}
+		if cp.filter != nil && !cp.filter.match(r.Market, code) {
+			continue
+		}
+		if cp.asof != "" && !visibleAt(r.SrcTime, cp.asof) {
+			continue
+		}
+		if err = emit(code, r); err != nil {
+			return err
 		}
-		dv = append(dv, r)
 	}
-	cv = append(cv, CodeValue{lastCode, dv})
-	return cv, nil
+	return cp.rows.Err()
 }
 
 /**
@@ -159,6 +394,9 @@ func (c *colValue) sqlRowHandle(rows *sql.Rows) (code string, dv DateValue, err
 		return
 	}
 	for i := 0; i < len(c.values); i++ {
+		if c.skip != nil && c.skip[i] {
+			continue
+		}
 		value := string(c.values[i])
 		if c.colNames[i] == CODE {
 			code = value
@@ -173,10 +411,12 @@ func (c *colValue) sqlRowHandle(rows *sql.Rows) (code string, dv DateValue, err
 		if c.colTypes[i].ScanType() == reflect.TypeOf(time.Time{}) {
 			// 时间类型需要特殊处理
 			if c.colNames[i] == srcTime {
-				// rtime(在mysql中为src-time) 需要保留 YYYY-MM-DD hh:ii:ss.micro 的格式
-				t, _ := time.Parse(time.RFC3339Nano, value)
+				// rtime(在mysql中为src-time) 需要保留 YYYY-MM-DD hh:ii:ss.micro 的格式，为NULL时为空
 				// src-time不放到row value里面
-				dv.SrcTime = t.Format("2006-01-02 15:04:05.000000")
+				if c.values[i] != nil {
+					t, _ := time.Parse(time.RFC3339Nano, value)
+					dv.SrcTime = t.Format(srcTimeLayout)
+				}
 			} else {
 				// 将时间的字符串转换成YYYYMMDD形式的整数
 				if c.colNames[i] == DATETIME {
@@ -184,10 +424,14 @@ func (c *colValue) sqlRowHandle(rows *sql.Rows) (code string, dv DateValue, err
 					// datetime不放到row value里面
 					continue
 				}
-				dv.Value[c.colNames[i]] = strconv.Itoa(date2Int(value))
+				if c.values[i] == nil {
+					dv.Value[c.colNames[i]] = nil
+				} else {
+					dv.Value[c.colNames[i]] = date2Int(value)
+				}
 			}
 		} else {
-			dv.Value[c.colNames[i]] = value
+			dv.Value[c.colNames[i]] = c.typedValue(i)
 		}
 	}
 	return
@@ -302,25 +546,11 @@ func date2Int(timeString string) (dateInt int) {
  * @return error
  */
 func getFins(taskName string) ([]string, error) {
-	// 仅限自营，isvalid=2
-	querySql := fmt.Sprintf("SELECT finname from %s.%s where taskname = '%s' and isvalid = 2;",
-		tables.schemaName, tables.finInfo, taskName)
-	rows, err := finDB.Raw(querySql).Rows()
-	if err != nil {
-		return nil, err
+	m := getMeta()
+	if _, ok := m.tasks[taskName]; !ok {
+		return nil, fmt.Errorf("task %s not exists", taskName)
 	}
-	defer rows.Close()
-	var fins []string
-	var fin string
-	for rows.Next() {
-		err = rows.Scan(&fin)
-		if err != nil {
-			log.Println(err.Error())
-		} else {
-			fins = append(fins, fin)
-		}
-	}
-	return fins, err
+	return m.taskFins[taskName], nil
 }
 
 /**
@@ -330,21 +560,21 @@ func getFins(taskName string) ([]string, error) {
  * @return bool
  */
 func isTime(fieldName string) bool {
-	fType, ok := pgFieldType[fieldName]
-	if ok {
-		return fType == pgTypeTime
-	}
-	// 301 是财务数据的起始字段，且301特殊处理
-	// sql本身不区分大小写，查出来的字段名都是小写，但是财务数据配置表中有为大写的，因此使用sql中的lower函数统一转换成小写进行处理
-	querySql := fmt.Sprintf("select cj_type from %s.%s where lower(cj_field) = '%s' and (position('已废弃' in cj_table) = 0 or cj_table is null)and dmno > 301;",
-		tables.schemaName, tables.fieldInfo, fieldName)
-	row := finDB.Raw(querySql).Row()
-	err := row.Scan(&fType)
-	if err != nil {
-		// TODO 错误处理
-		return false
+	return getMeta().fieldTypes[fieldName] == pgTypeTime
+}
+
+/**
+ * @Description: 从字段信息缓存中批量获取字段类型（cj_type），用于parquet等有类型的输出
+ * @param fields 字段名，sql结果中的字段名均为小写
+ * @return types 字段名=>类型，配置表中不存在的字段不在其中
+ */
+func getFieldTypes(fields []string) (types map[string]string) {
+	types = make(map[string]string)
+	fieldTypes := getMeta().fieldTypes
+	for _, field := range fields {
+		if fType, ok := fieldTypes[field]; ok {
+			types[field] = fType
+		}
 	}
-	fmt.Println("type of", fieldName, ":", fType)
-	pgFieldType[fieldName] = fType
-	return fType == pgTypeTime
+	return
 }
@@ -0,0 +1,35 @@
+package dao
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortCodeValues(t *testing.T) {
+	dv := func(market string, datetime int, srcTime string) DateValue {
+		return DateValue{Market: market, DateTime: datetime, SrcTime: srcTime}
+	}
+	cv := []CodeValue{
+		{Code: "600000", TimeList: []DateValue{dv("17", 20210803, "")}},
+		{Code: "300093", TimeList: []DateValue{dv("33", 20210804, "2021-08-04 09:00:00.000000"), dv("33", 20210803, "")}},
+		{Code: "300033", TimeList: []DateValue{
+			dv("33", 20210803, "2021-08-03 10:00:00.000000"),
+			dv("33", 20210803, "2021-08-03 09:00:00.000000"),
+			dv("33", 20210802, "2021-08-02 09:00:00.000000"),
+		}},
+		{Code: "000001", TimeList: []DateValue{dv("33", 20210803, "")}},
+	}
+	sortCodeValues(cv)
+	codes := make([]string, 0, len(cv))
+	for _, c := range cv {
+		codes = append(codes, c.TimeList[0].Market+":"+c.Code)
+	}
+	assert.Equal(t, []string{"17:600000", "33:000001", "33:300033", "33:300093"}, codes)
+	assert.Equal(t, []DateValue{
+		dv("33", 20210802, "2021-08-02 09:00:00.000000"),
+		dv("33", 20210803, "2021-08-03 09:00:00.000000"),
+		dv("33", 20210803, "2021-08-03 10:00:00.000000"),
+	}, cv[2].TimeList)
+	assert.Equal(t, []DateValue{dv("33", 20210803, ""), dv("33", 20210804, "2021-08-04 09:00:00.000000")}, cv[3].TimeList)
+}
@@ -5,9 +5,10 @@ package dao
 
 import (
 	"github.com/google/wire"
+	applog "pg-adapter/app/logger"
 )
 
 //go:generate wire
 func newTestDao() (*dao, func(), error) {
-	panic(wire.Build(newDao, NewDB))
+	panic(wire.Build(newDao, NewDB, applog.New))
 }
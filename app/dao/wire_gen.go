@@ -7,22 +7,30 @@ package dao
 
 import (
 	_ "github.com/lib/pq"
+	"pg-adapter/app/logger"
 )
 
 // Injectors from wire.go:
 
 //go:generate wire
 func newTestDao() (*dao, func(), error) {
-	db, cleanup, err := NewDB()
+	loggerLogger, cleanup, err := logger.New()
 	if err != nil {
 		return nil, nil, err
 	}
-	daoDao, cleanup2, err := newDao(db)
+	db, cleanup2, err := NewDB(loggerLogger)
 	if err != nil {
 		cleanup()
 		return nil, nil, err
 	}
+	daoDao, cleanup3, err := newDao(db)
+	if err != nil {
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
 	return daoDao, func() {
+		cleanup3()
 		cleanup2()
 		cleanup()
 	}, nil
@@ -6,11 +6,13 @@ package di
 import (
 	"github.com/google/wire"
 	"pg-adapter/app/dao"
+	"pg-adapter/app/logger"
 	"pg-adapter/app/server/dapr"
 	"pg-adapter/app/service"
+	"pg-adapter/app/trace"
 )
 
 //go:generate wire
 func InitApp() (*App, func(), error) {
-	panic(wire.Build(dao.Provider, service.Provider, dapr.New, NewApp))
+	panic(wire.Build(logger.New, trace.New, dao.Provider, service.Provider, dapr.New, NewApp))
 }
@@ -7,44 +7,67 @@ package di
 
 import (
 	"pg-adapter/app/dao"
+	"pg-adapter/app/logger"
 	"pg-adapter/app/server/dapr"
 	"pg-adapter/app/service"
+	"pg-adapter/app/trace"
 )
 
 // Injectors from wire.go:
 
 //go:generate wire
 func InitApp() (*App, func(), error) {
-	db, cleanup, err := dao.NewDB()
+	loggerLogger, cleanup, err := logger.New()
 	if err != nil {
 		return nil, nil, err
 	}
-	daoDao, cleanup2, err := dao.New(db)
+	db, cleanup2, err := dao.NewDB(loggerLogger)
 	if err != nil {
 		cleanup()
 		return nil, nil, err
 	}
-	serviceService, cleanup3, err := service.New(daoDao)
+	daoDao, cleanup3, err := dao.New(db)
 	if err != nil {
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	commonService, err := dapr.New(serviceService)
+	serviceService, cleanup4, err := service.New(daoDao)
 	if err != nil {
 		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
-	app, cleanup4, err := NewApp(serviceService, commonService)
+	tracer, cleanup5, err := trace.New()
 	if err != nil {
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	commonService, err := dapr.New(serviceService, tracer)
+	if err != nil {
+		cleanup5()
+		cleanup4()
+		cleanup3()
+		cleanup2()
+		cleanup()
+		return nil, nil, err
+	}
+	app, cleanup6, err := NewApp(serviceService, commonService)
+	if err != nil {
+		cleanup5()
+		cleanup4()
 		cleanup3()
 		cleanup2()
 		cleanup()
 		return nil, nil, err
 	}
 	return app, func() {
+		cleanup6()
+		cleanup5()
 		cleanup4()
 		cleanup3()
 		cleanup2()
@@ -0,0 +1,236 @@
+// Package logger 分级的结构化日志
+// 每条日志为一行json，包含时间、等级、消息及调用方传入的键值对；另有统计日志记录每个请求及导出的执行情况
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"pg-adapter/app/config"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level 日志等级
+type Level int32
+
+// 日志等级，由低到高
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// auditLevel 审计日志的等级名，审计日志始终输出
+const auditLevel = "audit"
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+/**
+ * @Description: 解析日志等级
+ * @param s debug/info/warn/error
+ * @return Level
+ * @return error
+ */
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q, should be one of debug/info/warn/error", s)
+}
+
+/**
+ * Logger 结构化日志，并发安全
+ */
+type Logger struct {
+	level int32 // Level，原子读写
+	mu    sync.Mutex
+	out   io.Writer
+}
+
+// 默认输出到标准错误，New之后输出到LogPath；统计日志默认不输出
+var (
+	std  = &Logger{level: int32(InfoLevel), out: os.Stderr}
+	stat = &Logger{level: int32(InfoLevel), out: io.Discard}
+)
+
+/*New
+ * @Description: 按配置初始化日志及统计日志，LogPath/StatLogPath为空时分别输出到标准错误及不输出
+ * @return l 应用日志
+ * @return cf 关闭日志文件
+ * @return err
+ */
+func New() (l *Logger, cf func(), err error) {
+	config.GetConfigure()
+	setting := config.Setting()
+	level := InfoLevel
+	if setting.LogLevel != "" {
+		if level, err = ParseLevel(setting.LogLevel); err != nil {
+			return nil, nil, err
+		}
+	}
+	opt := rotateOption{maxSize: int64(setting.LogMaxSize) << 20, maxBackups: setting.LogMaxBackups}
+	var closers []io.Closer
+	cf = func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}
+	if setting.LogPath != "" {
+		f, err := newRotateFile(setting.LogPath, opt)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, f)
+		std.setOutput(f)
+	}
+	if setting.StatLogPath != "" {
+		f, err := newRotateFile(setting.StatLogPath, opt)
+		if err != nil {
+			cf()
+			return nil, nil, err
+		}
+		closers = append(closers, f)
+		stat.setOutput(f)
+	}
+	std.SetLevel(level)
+	return std, cf, nil
+}
+
+// Default 返回应用日志
+func Default() *Logger {
+	return std
+}
+
+func (l *Logger) setOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out = w
+}
+
+// SetLevel 修改日志等级
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Level 当前日志等级
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+// Enabled 该等级的日志是否输出
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+/**
+ * @Description: 输出一条日志
+ * @param level
+ * @param msg
+ * @param kv 键值对，键为string，键为error类型的值输出其Error()
+ */
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.write(level.String(), msg, kv)
+}
+
+/**
+ * @Description: 不判断日志等级直接输出一条日志
+ * @param level 输出的等级名
+ * @param msg
+ * @param kv
+ */
+func (l *Logger) write(level string, msg string, kv []interface{}) {
+	entry := make(map[string]interface{}, len(kv)/2+3)
+	entry["time"] = time.Now().Format("2006-01-02 15:04:05.000000")
+	entry["level"] = level
+	entry["msg"] = msg
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		if i+1 == len(kv) {
+			entry[key] = nil
+			break
+		}
+		switch v := kv[i+1].(type) {
+		case error:
+			entry[key] = v.Error()
+		case time.Duration:
+			entry[key] = v.String()
+		default:
+			entry[key] = v
+		}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{"time": entry["time"], "level": entry["level"], "msg": msg, "logerr": err.Error()})
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(b)
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(DebugLevel, msg, kv...) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.Log(InfoLevel, msg, kv...) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.Log(WarnLevel, msg, kv...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(ErrorLevel, msg, kv...) }
+
+func Debug(msg string, kv ...interface{}) { std.Log(DebugLevel, msg, kv...) }
+func Info(msg string, kv ...interface{})  { std.Log(InfoLevel, msg, kv...) }
+func Warn(msg string, kv ...interface{})  { std.Log(WarnLevel, msg, kv...) }
+func Error(msg string, kv ...interface{}) { std.Log(ErrorLevel, msg, kv...) }
+
+// Fatal 输出错误日志后退出
+func Fatal(msg string, kv ...interface{}) {
+	std.Log(ErrorLevel, msg, kv...)
+	os.Exit(1)
+}
+
+/**
+ * @Description: 修改应用日志等级
+ * @param level debug/info/warn/error
+ * @return error
+ */
+func SetLevel(level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	std.SetLevel(l)
+	return nil
+}
+
+/**
+ * @Description: 输出一条审计日志（等级为audit）到应用日志，不受日志等级限制
+ * @param msg
+ * @param kv 键值对
+ */
+func Audit(msg string, kv ...interface{}) {
+	std.write(auditLevel, msg, kv)
+}
+
+/**
+ * @Description: 输出一条统计日志，每个请求及每个财务文件的导出各一条
+ * @param msg 统计类型，如request、fin
+ * @param kv 键值对
+ */
+func Stat(msg string, kv ...interface{}) {
+	stat.Log(InfoLevel, msg, kv...)
+}
@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{level: int32(InfoLevel), out: &buf}
+	l.Debug("hidden")
+	l.Info("query", "fin", "test.fin", "rows", 3, "error", errors.New("bad sql"))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "query", entry["msg"])
+	assert.Equal(t, "test.fin", entry["fin"])
+	assert.Equal(t, float64(3), entry["rows"])
+	assert.Equal(t, "bad sql", entry["error"])
+
+	l.SetLevel(DebugLevel)
+	l.Debug("shown")
+	assert.True(t, strings.Contains(buf.String(), `"shown"`))
+	_, err := ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	var buf bytes.Buffer
+	old := std
+	defer func() { std = old }()
+	std = &Logger{level: int32(ErrorLevel), out: &buf}
+	Info("hidden")
+	Audit("cmd", "cmd", "loglevel")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	var entry map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "audit", entry["level"])
+	assert.Equal(t, "loglevel", entry["cmd"])
+}
+
+func TestRotateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logger")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.log")
+	now := time.Date(2021, 8, 3, 10, 0, 0, 0, time.Local)
+	r, err := newRotateFile(path, rotateOption{maxSize: 10, maxBackups: 1})
+	assert.Nil(t, err)
+	r.now = func() time.Time { return now }
+	r.day = "20210803"
+	defer r.Close()
+
+	_, _ = r.Write([]byte("12345678\n"))
+	// 超过大小切分
+	_, _ = r.Write([]byte("abcdefgh\n"))
+	// 跨天切分，且只保留一个历史文件
+	now = now.Add(24 * time.Hour)
+	_, _ = r.Write([]byte("next day\n"))
+
+	content, _ := ioutil.ReadFile(path)
+	assert.Equal(t, "next day\n", string(content))
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Equal(t, 1, len(backups))
+	content, _ = ioutil.ReadFile(backups[0])
+	assert.Equal(t, "abcdefgh\n", string(content))
+}
@@ -0,0 +1,121 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102-150405"
+
+/**
+ * @Description: 日志文件切分配置
+ */
+type rotateOption struct {
+	maxSize    int64 // 单个文件最大字节数，<=0为不按大小切分
+	maxBackups int   // 保留的历史文件数，<=0为全部保留
+}
+
+/**
+ * rotateFile 按天及按大小切分的日志文件
+ * 切分时当前文件重命名为 文件名.YYYYMMDD-hhmmss，再新建文件继续写入
+ */
+type rotateFile struct {
+	path string
+	opt  rotateOption
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	day  string // 当前文件的日期 YYYYMMDD
+	now  func() time.Time
+}
+
+func newRotateFile(path string, opt rotateOption) (*rotateFile, error) {
+	r := &rotateFile{path: path, opt: opt, now: time.Now}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open 打开（追加）日志文件，文件日期取修改时间
+func (r *rotateFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	r.day = r.now().Format("20060102")
+	if info.Size() > 0 {
+		r.day = info.ModTime().Format("20060102")
+	}
+	return nil
+}
+
+func (r *rotateFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if r.size > 0 && (now.Format("20060102") != r.day || (r.opt.maxSize > 0 && r.size+int64(len(p)) > r.opt.maxSize)) {
+		if err := r.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate 切分当前文件并清理超出数量的历史文件
+func (r *rotateFile) rotate(now time.Time) error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	backup := r.path + "." + now.Format(backupTimeFormat)
+	if _, err := os.Stat(backup); err == nil {
+		// 同一秒内多次切分时追加纳秒避免覆盖
+		backup += "." + strings.TrimLeft(now.Format(".000000000"), ".")
+	}
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.day = now.Format("20060102")
+	r.removeBackups()
+	return nil
+}
+
+func (r *rotateFile) removeBackups() {
+	if r.opt.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil || len(backups) <= r.opt.maxBackups {
+		return
+	}
+	// 文件名中的时间可按字典序排序
+	sort.Strings(backups)
+	for _, b := range backups[:len(backups)-r.opt.maxBackups] {
+		_ = os.Remove(b)
+	}
+}
+
+func (r *rotateFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,281 @@
+// Package metrics 以prometheus文本格式输出服务指标
+// 仅实现服务所需的带标签计数器、直方图及采集时计算的指标，所有指标注册在同一个默认注册表中
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 指标类型
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefBuckets 默认直方图分桶（秒）
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// collector 可输出到注册表的指标
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type registry struct {
+	mu         sync.Mutex
+	names      map[string]bool
+	collectors []collector
+}
+
+var defaultRegistry = &registry{names: make(map[string]bool)}
+
+func (r *registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo 输出所有指标
+func WriteTo(w io.Writer) error {
+	defaultRegistry.mu.Lock()
+	collectors := append([]collector{}, defaultRegistry.collectors...)
+	defaultRegistry.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler 指标输出的http接口
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = WriteTo(w)
+	})
+}
+
+// desc 指标描述
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// key 标签值组合的唯一标识
+func (d *desc) key(lvs []string) string {
+	if len(lvs) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(lvs)))
+	}
+	return strings.Join(lvs, "\xff")
+}
+
+// sample 输出一行数据，extra为额外的标签（如直方图的le）
+func (d *desc) sample(w *bufio.Writer, name string, lvs []string, extra string, v float64) {
+	w.WriteString(name)
+	if len(lvs) != 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", l, escape(lvs[i]))
+		}
+		if extra != "" {
+			if len(lvs) != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys 按key排序保证输出顺序稳定
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/**
+ * CounterVec 带标签的计数器
+ */
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	lvs    map[string][]string
+	values map[string]float64
+}
+
+// NewCounterVec 创建并注册计数器
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: TypeCounter, labels: labels},
+		lvs:    make(map[string][]string),
+		values: make(map[string]float64),
+	}
+	defaultRegistry.register(name, c)
+	return c
+}
+
+// Add 增加v，lvs为与标签一一对应的标签值
+func (c *CounterVec) Add(v float64, lvs ...string) {
+	k := c.key(lvs)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.lvs[k]; !ok {
+		c.lvs[k] = append([]string{}, lvs...)
+	}
+	c.values[k] += v
+}
+
+// Inc 加1
+func (c *CounterVec) Inc(lvs ...string) {
+	c.Add(1, lvs...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, k := range sortedKeys(c.lvs) {
+		c.sample(w, c.name, c.lvs[k], "", c.values[k])
+	}
+}
+
+/**
+ * HistogramVec 带标签的直方图
+ */
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	lvs     map[string][]string
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // 每个分桶的计数（非累计）
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec 创建并注册直方图，buckets为空时使用DefBuckets
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: TypeHistogram, labels: labels},
+		buckets: append([]float64{}, buckets...),
+		lvs:     make(map[string][]string),
+		values:  make(map[string]*histogram),
+	}
+	sort.Float64s(h.buckets)
+	defaultRegistry.register(name, h)
+	return h
+}
+
+// Observe 记录一次观测值
+func (h *HistogramVec) Observe(v float64, lvs ...string) {
+	k := h.key(lvs)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[k]
+	if !ok {
+		h.lvs[k] = append([]string{}, lvs...)
+		hv = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, k := range sortedKeys(h.lvs) {
+		hv, lvs := h.values[k], h.lvs[k]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hv.counts[i]
+			h.sample(w, h.name+"_bucket", lvs, fmt.Sprintf("le=\"%s\"", formatFloat(b)), float64(cumulative))
+		}
+		h.sample(w, h.name+"_bucket", lvs, `le="+Inf"`, float64(hv.count))
+		h.sample(w, h.name+"_sum", lvs, "", hv.sum)
+		h.sample(w, h.name+"_count", lvs, "", float64(hv.count))
+	}
+}
+
+/**
+ * Sample 采集时计算的指标的一个值
+ */
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// funcVec 采集时调用fn计算的指标，如连接池状态
+type funcVec struct {
+	desc
+	fn func() []Sample
+}
+
+// NewFuncVec 创建并注册采集时计算的指标，typ为TypeCounter或TypeGauge
+func NewFuncVec(name string, help string, typ string, fn func() []Sample, labels ...string) {
+	defaultRegistry.register(name, &funcVec{desc: desc{name: name, help: help, typ: typ, labels: labels}, fn: fn})
+}
+
+func (f *funcVec) write(w *bufio.Writer) {
+	f.header(w)
+	for _, s := range f.fn() {
+		if len(s.LabelValues) != len(f.labels) {
+			continue
+		}
+		f.sample(w, f.name, s.LabelValues, "", s.Value)
+	}
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "test requests", "route")
+	c.Inc("/query")
+	c.Add(2, "/query")
+	h := NewHistogramVec("test_duration_seconds", "test duration", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/query")
+	h.Observe(0.5, "/query")
+	h.Observe(5, "/query")
+	NewFuncVec("test_open_connections", "test gauge", TypeGauge, func() []Sample {
+		return []Sample{{LabelValues: []string{`a"b`}, Value: 3}}
+	}, "dsn")
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteTo(&buf))
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="/query"} 3`,
+		`test_duration_seconds_bucket{route="/query",le="0.1"} 1`,
+		`test_duration_seconds_bucket{route="/query",le="1"} 2`,
+		`test_duration_seconds_bucket{route="/query",le="+Inf"} 3`,
+		`test_duration_seconds_count{route="/query"} 3`,
+		`test_open_connections{dsn="a\"b"} 3`,
+	} {
+		assert.True(t, strings.Contains(out, line+"\n"), line)
+	}
+}
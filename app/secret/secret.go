@@ -0,0 +1,132 @@
+// Package secret 解析配置中的密钥引用
+// 支持三种引用，非引用的值原样返回：
+//
+//	dapr:仓库名/密钥名[#字段名] 通过dapr secret store获取
+//	env:环境变量名
+//	file:文件路径 取文件内容并去掉末尾换行
+package secret
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"pg-adapter/pkg/go-sdk/client"
+	"strings"
+	"sync"
+)
+
+// 引用前缀
+const (
+	PrefixDapr = "dapr:"
+	PrefixEnv  = "env:"
+	PrefixFile = "file:"
+)
+
+// Store dapr secret store，由dapr client实现
+type Store interface {
+	GetSecret(ctx context.Context, storeName, key string, meta map[string]string) (data map[string]string, err error)
+}
+
+var (
+	daprStore Store // 第一次解析dapr引用时创建
+	storeLock sync.Mutex
+)
+
+// IsRef 是否为密钥引用
+func IsRef(v string) bool {
+	return strings.HasPrefix(v, PrefixDapr) || strings.HasPrefix(v, PrefixEnv) || strings.HasPrefix(v, PrefixFile)
+}
+
+/**
+ * @Description: 解析密钥引用，非引用的值原样返回
+ * @param ctx
+ * @param v
+ * @return string 密钥值
+ * @return error
+ */
+func Resolve(ctx context.Context, v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, PrefixEnv):
+		name := strings.TrimPrefix(v, PrefixEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("secret env %s not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(v, PrefixFile):
+		path := strings.TrimPrefix(v, PrefixFile)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read secret file %s: %v", path, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case strings.HasPrefix(v, PrefixDapr):
+		return resolveDapr(ctx, strings.TrimPrefix(v, PrefixDapr))
+	default:
+		return v, nil
+	}
+}
+
+/**
+ * @Description: 从dapr secret store获取密钥
+ * @param ctx
+ * @param ref 仓库名/密钥名[#字段名]，未指定字段时取与密钥同名的字段，密钥只有一个字段时取该字段
+ * @return string
+ * @return error
+ */
+func resolveDapr(ctx context.Context, ref string) (string, error) {
+	storeName, key, field, err := parseDaprRef(ref)
+	if err != nil {
+		return "", err
+	}
+	store, err := getDaprStore()
+	if err != nil {
+		return "", err
+	}
+	data, err := store.GetSecret(ctx, storeName, key, nil)
+	if err != nil {
+		return "", fmt.Errorf("get secret %s/%s: %v", storeName, key, err)
+	}
+	if field == "" {
+		if value, ok := data[key]; ok {
+			return value, nil
+		}
+		if len(data) == 1 {
+			for _, value := range data {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("secret %s/%s has %d fields, please specify one by #field", storeName, key, len(data))
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no field %s", storeName, key, field)
+	}
+	return value, nil
+}
+
+func parseDaprRef(ref string) (storeName string, key string, field string, err error) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		ref, field = ref[:i], ref[i+1:]
+	}
+	i := strings.Index(ref, "/")
+	if i <= 0 || i == len(ref)-1 {
+		return "", "", "", fmt.Errorf("invalid dapr secret reference %q, should be %sstore/key[#field]", PrefixDapr+ref, PrefixDapr)
+	}
+	return ref[:i], ref[i+1:], field, nil
+}
+
+// getDaprStore 使用DAPR_GRPC_PORT连接dapr sidecar
+func getDaprStore() (Store, error) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if daprStore == nil {
+		c, err := client.NewClient()
+		if err != nil {
+			return nil, err
+		}
+		daprStore = c
+	}
+	return daprStore, nil
+}
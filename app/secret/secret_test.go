@@ -0,0 +1,61 @@
+package secret
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mapStore map[string]map[string]string
+
+func (m mapStore) GetSecret(_ context.Context, storeName, key string, _ map[string]string) (map[string]string, error) {
+	return m[storeName+"/"+key], nil
+}
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	v, err := Resolve(ctx, "plain password")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain password", v)
+
+	os.Setenv("PG_ADAPTER_TEST_PASSWD", "from env")
+	defer os.Unsetenv("PG_ADAPTER_TEST_PASSWD")
+	v, err = Resolve(ctx, "env:PG_ADAPTER_TEST_PASSWD")
+	assert.Nil(t, err)
+	assert.Equal(t, "from env", v)
+	_, err = Resolve(ctx, "env:PG_ADAPTER_TEST_NOT_SET")
+	assert.NotNil(t, err)
+
+	dir, err := ioutil.TempDir("", "secret")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "passwd")
+	assert.Nil(t, ioutil.WriteFile(path, []byte("from file\n"), 0600))
+	v, err = Resolve(ctx, "file:"+path)
+	assert.Nil(t, err)
+	assert.Equal(t, "from file", v)
+
+	daprStore = mapStore{
+		"vault/pg":   {"pg": "same name"},
+		"vault/task": {"user": "u", "password": "p"},
+		"vault/one":  {"value": "only"},
+	}
+	defer func() { daprStore = nil }()
+	for ref, want := range map[string]string{
+		"dapr:vault/pg":            "same name",
+		"dapr:vault/task#password": "p",
+		"dapr:vault/one":           "only",
+	} {
+		v, err = Resolve(ctx, ref)
+		assert.Nil(t, err, ref)
+		assert.Equal(t, want, v, ref)
+	}
+	for _, ref := range []string{"dapr:vault/task", "dapr:vault/task#missing", "dapr:vault", "dapr:/pg"} {
+		_, err = Resolve(ctx, ref)
+		assert.NotNil(t, err, ref)
+	}
+}
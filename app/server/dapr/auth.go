@@ -0,0 +1,59 @@
+package dapr
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"net/http"
+	"pg-adapter/app/config"
+	"pg-adapter/app/dao"
+	"pg-adapter/app/logger"
+	"pg-adapter/app/secret"
+	"strings"
+	"time"
+)
+
+// 解析CmdToken密钥引用的超时时间
+const cmdTokenTimeout = 5 * time.Second
+
+// cmdToken /cmd所需的token，为空时禁用/cmd
+var cmdToken string
+
+/**
+ * @Description: 读取/cmd的token，配置为密钥引用时解析
+ * @return string
+ * @return error
+ */
+func loadCmdToken() (string, error) {
+	token := config.Service().CmdToken
+	if !secret.IsRef(token) {
+		return token, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cmdTokenTimeout)
+	defer cancel()
+	token, err := secret.Resolve(ctx, token)
+	return token, errors.Wrap(err, "resolve Service.CmdToken")
+}
+
+/**
+ * @Description: /cmd鉴权，请求头需带 Authorization: Bearer <token>，未配置token时拒绝所有请求
+ * @param c
+ */
+func cmdAuth(c *gin.Context) {
+	code, msg := http.StatusOK, ""
+	if cmdToken == "" {
+		code, msg = http.StatusForbidden, "cmd is disabled, please set Service.CmdToken"
+	} else {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cmdToken)) != 1 {
+			code, msg = http.StatusUnauthorized, "invalid cmd token"
+		}
+	}
+	if code == http.StatusOK {
+		c.Next()
+		return
+	}
+	logger.Audit("cmd", "client", c.ClientIP(), "cmd", dao.FormValue(c, CMD), "status", code, "msg", msg)
+	c.AbortWithStatusJSON(code, &dao.CmdRet{Code: code, Msg: msg})
+}
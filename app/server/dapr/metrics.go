@@ -0,0 +1,30 @@
+package dapr
+
+import (
+	"github.com/gin-gonic/gin"
+	"pg-adapter/app/metrics"
+	"strconv"
+	"time"
+)
+
+// 未匹配到路由的请求统一使用该标签，避免任意url造成标签膨胀
+const unmatchedRoute = "unmatched"
+
+var (
+	requestTotal = metrics.NewCounterVec("pg_adapter_http_requests_total",
+		"Number of http requests by route and status code.", "route", "code")
+	requestDuration = metrics.NewHistogramVec("pg_adapter_http_request_duration_seconds",
+		"Duration of http requests by route.", nil, "route")
+)
+
+// metricsMiddleware 记录每个路由的请求数及耗时
+func metricsMiddleware(c *gin.Context) {
+	begin := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	requestTotal.Inc(route, strconv.Itoa(c.Writer.Status()))
+	requestDuration.Observe(time.Since(begin).Seconds(), route)
+}
@@ -0,0 +1,106 @@
+package dapr
+
+import (
+	"github.com/gin-gonic/gin"
+	"pg-adapter/app/dao"
+	"strings"
+)
+
+// FORMAT 指定返回格式的请求参数，优先于请求头Accept
+const FORMAT = "format"
+
+// 返回格式
+const (
+	formatJSON    = "json"
+	formatNDJSON  = "ndjson"
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+)
+
+// 返回格式对应的Content-Type
+const (
+	MIMECSV     = "text/csv"
+	MIMEParquet = "application/vnd.apache.parquet"
+)
+
+/**
+ * @Description: 获取请求的返回格式，format参数为空时按请求头Accept判断，默认为json
+ * @param c
+ * @return string
+ */
+func outputFormat(c *gin.Context) string {
+	switch strings.ToLower(dao.FormValue(c, FORMAT)) {
+	case formatCSV:
+		return formatCSV
+	case formatNDJSON:
+		return formatNDJSON
+	case formatParquet:
+		return formatParquet
+	case formatJSON:
+		return formatJSON
+	}
+	accept := c.GetHeader("Accept")
+	switch {
+	case strings.Contains(accept, MIMENDJSON):
+		return formatNDJSON
+	case strings.Contains(accept, MIMECSV):
+		return formatCSV
+	case strings.Contains(accept, MIMEParquet):
+		return formatParquet
+	}
+	return formatJSON
+}
+
+/**
+ * @Description: 以csv返回请求结果，请求失败时仍以json返回错误信息
+ * @Description: 下一页游标及状态信息放在响应头 X-Cursor、X-Status-Msg 中
+ * @param c
+ * @param qr
+ */
+func renderCSV(c *gin.Context, qr *dao.QueryRet) {
+	if qr.Code >= 400 {
+		c.JSON(qr.Code, qr)
+		return
+	}
+	c.Header("Content-Type", MIMECSV+"; charset=utf-8")
+	c.Header("X-Status-Msg", headerValue(qr.Msg))
+	if qr.Cursor != "" {
+		c.Header("X-Cursor", qr.Cursor)
+	}
+	c.Status(qr.Code)
+	if err := dao.WriteCSV(c.Writer, qr); err != nil {
+		_ = c.Error(err)
+	}
+}
+
+/**
+ * @Description: 去掉不能出现在响应头中的换行
+ * @param s
+ * @return string
+ */
+func headerValue(s string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(s, "\n", "; ")), " ")
+}
+
+/**
+ * @Description: 以parquet文件下载返回请求结果，请求失败时仍以json返回错误信息
+ * @Description: 与csv相同，下一页游标及状态信息放在响应头中
+ * @param c
+ * @param qr
+ */
+func renderParquet(c *gin.Context, qr *dao.QueryRet) {
+	if qr.Code >= 400 {
+		c.JSON(qr.Code, qr)
+		return
+	}
+	c.Header("Content-Type", MIMEParquet)
+	c.Header("Content-Disposition", `attachment; filename="export.parquet"`)
+	c.Header("X-Status-Msg", headerValue(qr.Msg))
+	if qr.Cursor != "" {
+		c.Header("X-Cursor", qr.Cursor)
+	}
+	c.Status(qr.Code)
+	if err := dao.WriteParquet(c.Writer, qr); err != nil {
+		_ = c.Error(err)
+	}
+}
@@ -8,16 +8,27 @@ import (
 	"net/http"
 	"pg-adapter/api"
 	"pg-adapter/app/dao"
+	"pg-adapter/app/logger"
+	"pg-adapter/app/metrics"
+	"pg-adapter/app/service"
+	"pg-adapter/app/trace"
 	negt "pg-adapter/pkg/go-sdk/service/http"
 	"time"
 )
 
 var svc api.NegtServer
 
+// CMD 管理命令名参数
+const CMD = "cmd"
+
 // New Server 服务层，该层封装服务级别的接口函数，
 // 如http服务对外提供的url,grpc服务对外提供的proto
 // New 提供服务的创建方法，在di中进行依赖注入
-func New(s api.NegtServer) (srv common.Service, err error) {
+func New(s api.NegtServer, t *trace.Tracer) (srv common.Service, err error) {
+	tracer = t
+	if cmdToken, err = loadCmdToken(); err != nil {
+		return nil, err
+	}
 	// 创建路由转发
 	r := gin.Default()
 	mux := http.NewServeMux()
@@ -33,30 +44,85 @@ func New(s api.NegtServer) (srv common.Service, err error) {
 //127.0.0.1:9090/hello
 // initRoute http请求路由设置
 func initRoute(r *gin.Engine) {
+	r.Use(metricsMiddleware, traceMiddleware)
 	r.GET("/query", queryHandler)
+	r.POST("/query", queryHandler)
 	r.GET("/export", exportHandler) //方便适配老版财务数据业务的后门
+	r.POST("/export", exportHandler)
 	r.GET("/ping", pingHandler)
-	r.GET("/cmd", cmdHandler)
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", readyzHandler)
+	r.GET("/cmd", cmdAuth, cmdHandler)
+	r.POST("/cmd", cmdAuth, cmdHandler)
+	r.GET("/metrics", gin.WrapH(metrics.Handler())) // prometheus指标
 }
 
-// cmdHandler 管理命令url
+/**
+ * @Description: 管理命令，每次执行均记录审计日志
+ * @Description: 需配置Service.CmdToken并在请求头中带上token；pools、cron可GET请求，其余修改服务状态的命令仅限POST
+ * @param c
+ * @example: 请求示例：curl -X POST -H 'Authorization: Bearer <token>' localhost:8080/cmd -d 'cmd=export&task=test'
+ * @example: 参数：
+ * @example: cmd: 命令名，reload 重新加载配置表；export 立即执行任务导出；pools 连接池状态；cron 定时任务；loglevel 修改pg日志等级
+ * @example: task: export 的任务名，该任务正在导出时返回409
+ * @example: logger: loglevel 修改的日志，pg（默认）或app
+ * @example: level: loglevel 的日志等级，pg日志为silent/error/warn/info，应用日志为debug/info/warn/error
+ */
 func cmdHandler(c *gin.Context) {
-	c.JSON(200, gin.H{})
+	name := dao.FormValue(c, CMD)
+	if c.Request.Method != http.MethodPost && !service.ReadOnlyCmd(name) {
+		logger.Audit("cmd", "client", c.ClientIP(), "cmd", name, "status", http.StatusMethodNotAllowed)
+		c.JSON(http.StatusMethodNotAllowed, &dao.CmdRet{Code: http.StatusMethodNotAllowed, Msg: fmt.Sprintf("cmd %q requires POST", name)})
+		return
+	}
+	args := make(map[string]string)
+	_ = c.Request.ParseForm()
+	for k, v := range c.Request.Form {
+		if k != CMD && len(v) != 0 {
+			args[k] = v[0]
+		}
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(svc.Timeout()))
+	defer cancel()
+	ret := svc.Cmd(ctx, name, args)
+	logger.Audit("cmd", "client", c.ClientIP(), "cmd", name, "args", args, "status", ret.Code, "msg", ret.Msg)
+	c.JSON(ret.Code, ret)
 }
 
-// ping命令
+// ping命令，所有pg连接均可用时返回pong
 func pingHandler(c *gin.Context) {
 	ctx := context.WithValue(context.Background(), "key", "value")
 	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(svc.Timeout()))
 	defer cancel()
 	err := svc.Ping(ctx)
 	if err != nil {
-		c.JSON(500, err)
+		c.JSON(500, err.Error())
 	} else {
 		c.JSON(200, "pong")
 	}
 }
 
+// healthzHandler 存活探针，服务能处理请求即为存活，不检查pg
+func healthzHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"status": dao.StatusUp})
+}
+
+/**
+ * @Description: 就绪探针，ping配置表所在库及所有任务库，全部可用时返回200，否则返回503
+ * @Description: 返回每个连接（密码已脱敏）的状态及耗时
+ * @param c
+ */
+func readyzHandler(c *gin.Context) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(svc.Timeout()))
+	defer cancel()
+	h := svc.Health(ctx)
+	code := 200
+	if h.Status != dao.StatusUp {
+		code = 503
+	}
+	c.JSON(code, h)
+}
+
 /**
  * @Description: 查询财务数据
  * @param c
@@ -65,18 +131,30 @@ func pingHandler(c *gin.Context) {
  * @example: datatype: 字段id，以逗号隔开：321,322
  * @example: datetime: 日期，开始日期-结束日期：20210803-20210803
  * @example: codelist: 市场及代码，代码可为空：17(),33(300033)
+ * @example: json请求示例：curl -X POST localhost:8080/query -H 'Content-Type: application/json'
+ * @example:   -d '{"fields":[2099],"markets":[{"market":17,"codes":[]}],"start":20210803,"end":20210803}'
+ * @example: json参数：
+ * @example: fields: 字段id数组
+ * @example: markets: 市场及代码数组，codes为空则取该市场全部代码
+ * @example: start/end: 起止日期，例如 20210803，为空则为昨天到今天
+ * @example: cursor: 分页游标（表单与json均可传），数据超过RowLimit条时返回结果中带有cursor，传入以获取下一页
+ * @example: merge: 字段分属多个财务文件时按 market,code,datetime 合并为一条数据（表单与json均可传），schema取较小的库名
+ * @example:   latest(或1/true): 同一字段有多个值时取src-time最新的，src-time为最新的；earliest: 取src-time最早的
+ * @example: snapshot: 快照日期，例如 20210803（json中为整数），传入时忽略datetime/start/end，每个代码返回一条，
+ * @example:   每个字段为该日期及之前最新（按datetime、src-time）的非空值，datetime、src-time为最新一条数据的
+ * @example:   与merge同时使用时各财务文件的快照按 market,code 合并，每个字段取最新的非空值
+ * @example: asof: 时点，例如 2021-08-03 15:04:05（仅日期时为当天结束），每个代码每个日期只返回src-time在该时刻及之前的最新版本，src-time为空的不返回
+ * @example:   与snapshot同时使用时返回该时刻可见的最新一条
+ * @example: 请求头带 Accept: application/x-ndjson 时流式返回，每行一条数据，最后一行为状态
+ * @example: format=csv 或请求头带 Accept: text/csv 时返回csv，列为 schema,code,market,datetime,src-time 及按datatype顺序的字段
  */
 func queryHandler(c *gin.Context) {
-	qp := dao.GetQueryPara(c)
-	ctxValue := map[string]interface{}{
-		dao.METHOD: dao.QUERY,
-		dao.VALUE:  qp,
+	qp, err := dao.GetQueryPara(c)
+	if err != nil {
+		c.JSON(400, &dao.QueryRet{Code: 400, Msg: err.Error(), Data: make([]dao.SchemaValue, 0)})
+		return
 	}
-	ctx := context.WithValue(context.Background(), dao.VALUE, ctxValue)
-	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(svc.Timeout()))
-	defer cancel()
-	qr := svc.Query(ctx)
-	c.JSON(qr.Code, qr)
+	handleQuery(c, dao.QUERY, qp)
 }
 
 /**
@@ -87,19 +165,54 @@ func queryHandler(c *gin.Context) {
  * @example: 参数：
  * @example: schema: 所属市场，对应mysql中库名（沪深不区分level1 level2），例如 shasefin sznsefin stbfin等
  * @example: finname: 财务文件名
- * @example: type: 导出类型，0-5分别是 全量、按日期、按时间、按代码、按实时（本质为选取配置库中对应sql
- * @example: startdate/enddate: 起止日期，例如 20210803
- * @example: codelist: 区别于query中的codelist，此处为纯代码
+ * @example: type: 导出类型，0-4分别是 全量(allproc)、按日期(repproc)、按时间(finproc)、按实时(realproc)、按代码(codeproc)，缺省为2（本质为选取配置库中对应sql
+ * @example: startdate/enddate: 起止日期，例如 20210803，type为1、2时使用，缺省为昨天到今天
+ * @example: codelist: 区别于query中的codelist，此处为纯代码，以逗号隔开，type为4时必填
+ * @example: cursor: 分页游标，同query
+ * @example: 与query相同，请求头带 Accept: application/x-ndjson 时流式返回，format=csv 时返回csv（字段按字段名排序）
+ * @example: format=parquet 时以parquet文件下载，列同csv，字段类型取自字段信息表
  */
 func exportHandler(c *gin.Context) {
 	eq := dao.GetExportPara(c)
+	handleQuery(c, dao.EXPORT, eq)
+}
+
+/**
+ * @Description: query与export公用的请求处理，按format参数或请求头选择返回json、ndjson流式返回、csv或parquet
+ * @Description: 每个请求输出一行统计日志
+ * @param c
+ * @param method dao.QUERY 或 dao.EXPORT
+ * @param value 解析后的请求参数
+ */
+func handleQuery(c *gin.Context, method int, value interface{}) {
 	ctxValue := map[string]interface{}{
-		dao.METHOD: dao.EXPORT,
-		dao.VALUE:  eq,
+		dao.METHOD: method,
+		dao.VALUE:  value,
+	}
+	format := outputFormat(c)
+	var sw *ndjsonWriter
+	if format == formatNDJSON {
+		sw = newNDJSONWriter(c)
+		ctxValue[dao.WRITER] = sw
 	}
-	ctx := context.WithValue(context.Background(), dao.VALUE, ctxValue)
+	// 基于请求的ctx，客户端断开或超时时取消pg中执行的sql
+	ctx := context.WithValue(c.Request.Context(), dao.VALUE, ctxValue)
 	ctx, cancel := context.WithDeadline(ctx, time.Now().Add(svc.Timeout()))
 	defer cancel()
+	begin := time.Now()
 	qr := svc.Query(ctx)
-	c.JSON(qr.Code, qr)
+	defer func() {
+		logger.Stat("request", "route", c.FullPath(), "client", c.ClientIP(), "format", format,
+			"status", qr.Code, "duration_ms", time.Since(begin).Milliseconds(), "msg", qr.Msg)
+	}()
+	switch format {
+	case formatNDJSON:
+		sw.finish(qr)
+	case formatCSV:
+		renderCSV(c, qr)
+	case formatParquet:
+		renderParquet(c, qr)
+	default:
+		c.JSON(qr.Code, qr)
+	}
 }
@@ -0,0 +1,78 @@
+package dapr
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"pg-adapter/app/dao"
+	"sync"
+)
+
+// MIMENDJSON 流式输出格式，每行一个json对象
+const MIMENDJSON = "application/x-ndjson"
+
+var errStreamClosed = errors.New("stream closed")
+
+/**
+ * @Description: ndjson流式输出，数据逐条写入http响应并立即flush
+ * @Description: 请求结束（包括超时）后关闭，关闭后的写入返回错误以停止后续sql结果处理
+ */
+type ndjsonWriter struct {
+	mu      sync.Mutex
+	c       *gin.Context
+	enc     *json.Encoder
+	started bool // 是否已写入响应头
+	closed  bool
+}
+
+func newNDJSONWriter(c *gin.Context) *ndjsonWriter {
+	return &ndjsonWriter{c: c, enc: json.NewEncoder(c.Writer)}
+}
+
+/**
+ * @Description: 写入单条数据，首次写入时以200写响应头
+ * @receiver w
+ * @param r
+ * @return error
+ */
+func (w *ndjsonWriter) WriteRecord(r dao.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errStreamClosed
+	}
+	w.writeHeader(200)
+	if err := w.enc.Encode(r); err != nil {
+		w.closed = true
+		return err
+	}
+	w.c.Writer.Flush()
+	return nil
+}
+
+/**
+ * @Description: 结束流式输出，最后一行写入请求状态 {"status_code":200,"status_msg":"succeed"}
+ * @Description: 未写入过数据时响应码与状态一致，否则响应码已为200
+ * @receiver w
+ * @param qr
+ */
+func (w *ndjsonWriter) finish(qr *dao.QueryRet) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.writeHeader(qr.Code)
+	_ = w.enc.Encode(gin.H{"status_code": qr.Code, "status_msg": qr.Msg})
+	w.c.Writer.Flush()
+}
+
+func (w *ndjsonWriter) writeHeader(code int) {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.c.Header("Content-Type", MIMENDJSON)
+	w.c.Status(code)
+}
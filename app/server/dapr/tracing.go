@@ -0,0 +1,38 @@
+package dapr
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"pg-adapter/app/trace"
+)
+
+// TRACEPARENT W3C链路追踪请求头
+const TRACEPARENT = "traceparent"
+
+var tracer *trace.Tracer
+
+/**
+ * @Description: 为每个请求开始一个span，请求头带有合法traceparent时作为其子span
+ * @Description: 响应头traceparent为本次请求的span，便于调用方关联
+ * @param c
+ */
+func traceMiddleware(c *gin.Context) {
+	remote, _ := trace.ParseTraceparent(c.GetHeader(TRACEPARENT))
+	route := c.FullPath()
+	if route == "" {
+		route = unmatchedRoute
+	}
+	ctx, span := tracer.Start(c.Request.Context(), c.Request.Method+" "+route, remote)
+	span.SetAttr("http.method", c.Request.Method)
+	span.SetAttr("http.route", route)
+	span.SetAttr("http.client_ip", c.ClientIP())
+	c.Header(TRACEPARENT, span.Context().Traceparent())
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+	status := c.Writer.Status()
+	span.SetAttr("http.status_code", status)
+	if status >= 400 {
+		span.SetError(errors.Errorf("http status %d", status))
+	}
+	span.End()
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pg-adapter/app/dao"
+	"pg-adapter/app/logger"
+	"strings"
+)
+
+// 管理命令
+const (
+	CmdReload   = "reload"   // 重新加载配置表缓存（任务、财务文件、sql、字段及定时任务）
+	CmdExport   = "export"   // 立即执行任务导出，参数task
+	CmdPools    = "pools"    // 查看所有pg连接池状态
+	CmdCron     = "cron"     // 查看定时任务
+	CmdLogLevel = "loglevel" // 修改日志等级，参数level及logger
+)
+
+// 管理命令参数
+const (
+	ArgTask   = "task"   // 任务名
+	ArgLevel  = "level"  // 日志等级，pg日志为silent/error/warn/info，应用日志为debug/info/warn/error
+	ArgLogger = "logger" // 修改的日志，pg（默认）或app
+)
+
+// 可修改等级的日志
+const (
+	LoggerPg  = "pg"  // pg连接日志
+	LoggerApp = "app" // 应用日志
+)
+
+var cmds = []string{CmdReload, CmdExport, CmdPools, CmdCron, CmdLogLevel}
+
+// readOnlyCmds 只读的命令，可以GET请求，其余命令仅限POST
+var readOnlyCmds = map[string]bool{CmdPools: true, CmdCron: true}
+
+/*ReadOnlyCmd
+ * @Description: 判断命令是否只读（不修改服务状态）
+ * @param name
+ * @return bool
+ */
+func ReadOnlyCmd(name string) bool {
+	return readOnlyCmds[name]
+}
+
+/*Cmd
+ * @Description: 执行管理命令
+ * @receiver s
+ * @param ctx
+ * @param name 命令名
+ * @param args 命令参数
+ * @return *dao.CmdRet
+ */
+func (s *Service) Cmd(ctx context.Context, name string, args map[string]string) *dao.CmdRet {
+	switch name {
+	case CmdReload:
+		if err := dao.ReloadMeta(); err != nil {
+			return &dao.CmdRet{Code: 500, Msg: err.Error()}
+		}
+		return cmdSucceed(dao.Meta())
+	case CmdExport:
+		task := args[ArgTask]
+		if !dao.HasTask(task) {
+			return &dao.CmdRet{Code: 400, Msg: fmt.Sprintf("task %q not exists", task)}
+		}
+		// 导出耗时较长，异步执行；同一任务正在导出（包括定时导出）时拒绝
+		err := dao.StartTaskProc(task, func(err error) {
+			if err != nil {
+				logger.Error("cmd export failed", "task", task, "error", err)
+			}
+		})
+		if errors.Is(err, dao.ErrTaskRunning) {
+			return &dao.CmdRet{Code: 409, Msg: err.Error()}
+		}
+		return cmdSucceed(map[string]string{ArgTask: task})
+	case CmdPools:
+		return cmdSucceed(dao.PoolStats())
+	case CmdCron:
+		return cmdSucceed(dao.CronSchedule())
+	case CmdLogLevel:
+		var err error
+		target := args[ArgLogger]
+		switch target {
+		case "", LoggerPg:
+			target = LoggerPg
+			err = dao.SetLogLevel(args[ArgLevel])
+		case LoggerApp:
+			err = logger.SetLevel(args[ArgLevel])
+		default:
+			err = fmt.Errorf("unknown logger %q, should be one of %s/%s", target, LoggerPg, LoggerApp)
+		}
+		if err != nil {
+			return &dao.CmdRet{Code: 400, Msg: err.Error()}
+		}
+		return cmdSucceed(map[string]string{ArgLogger: target, ArgLevel: args[ArgLevel]})
+	default:
+		return &dao.CmdRet{Code: 400, Msg: fmt.Sprintf("unknown cmd %q, should be one of %s", name, strings.Join(cmds, "/"))}
+	}
+}
+
+func cmdSucceed(data interface{}) *dao.CmdRet {
+	return &dao.CmdRet{Code: 200, Msg: "succeed", Data: data}
+}
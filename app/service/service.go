@@ -7,6 +7,7 @@ import (
 	"pg-adapter/api"
 	"pg-adapter/app/config"
 	"pg-adapter/app/dao"
+	"pg-adapter/app/trace"
 	"time"
 )
 
@@ -38,17 +39,36 @@ func (s *Service) Ping(ctx context.Context) error {
 	case <-ctx.Done():
 		return errors.New("stop")
 	default:
-		return nil
+		return s.dao.Ping(ctx)
 	}
 }
 
+/*Health
+ * @Description: 所有pg连接的健康检查，用于就绪探针
+ * @receiver s
+ * @param ctx
+ * @return *dao.HealthRet
+ */
+func (s *Service) Health(ctx context.Context) *dao.HealthRet {
+	return s.dao.Health(ctx)
+}
+
 /*Query
  * @Description: 处理query请求，实现对数据请求的超时管理，返回
+ * @Description: ctx同时传给dao，超时后dao中正在执行的sql随之取消并释放连接
  * @receiver s
  * @param ctx
  * @return err
  */
 func (s *Service) Query(ctx context.Context) (qr *dao.QueryRet) {
+	ctx, span := trace.Start(ctx, "Service.Query")
+	defer func() {
+		span.SetAttr("status_code", qr.Code)
+		if qr.Code >= 400 {
+			span.SetError(errors.New(qr.Msg))
+		}
+		span.End()
+	}()
 	ch := make(chan *dao.QueryRet, 1)
 	go func() {
 		ch <- s.dao.Query(ctx)
@@ -0,0 +1,255 @@
+// Package trace 请求链路追踪
+// 兼容W3C traceparent请求头，span结束时导出到文件（每行一个json）
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"pg-adapter/app/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+/**
+ * SpanContext 在服务间传递的span信息
+ */
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool // 是否记录，对应traceparent中的trace-flags
+}
+
+// IsValid trace id与span id均不为0
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+/**
+ * @Description: 生成traceparent请求头，格式为 00-traceid-spanid-flags
+ * @receiver sc
+ * @return string
+ */
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+/**
+ * @Description: 解析W3C traceparent请求头
+ * @param s 例如 00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01
+ * @return sc
+ * @return err
+ */
+func ParseTraceparent(s string) (sc SpanContext, err error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	// 版本00只有4段，ff为非法版本
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("invalid traceparent version %q", parts[0])
+	}
+	var flags [1]byte
+	if _, err = hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err = hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if _, err = hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid traceparent %q", s)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+/**
+ * Span 一次操作的耗时记录，nil Span的所有方法均可安全调用
+ */
+type Span struct {
+	tracer *Tracer
+	name   string
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   string
+	ended bool
+}
+
+// Context 返回span信息，用于向下游传递
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr 设置属性
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError 记录错误，err为nil时忽略
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End 结束span，采样的span导出，重复调用只导出一次
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := &SpanData{
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Name:       s.name,
+		Start:      s.start,
+		End:        end,
+		DurationMs: float64(end.Sub(s.start).Microseconds()) / 1000,
+		Attributes: s.attrs,
+		Status:     StatusOk,
+		Error:      s.err,
+	}
+	s.mu.Unlock()
+	if s.parent.IsValid() {
+		data.ParentSpanID = s.parent.String()
+	}
+	if data.Error != "" {
+		data.Status = StatusError
+	}
+	if s.sc.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(data)
+	}
+}
+
+/**
+ * Tracer 创建span并将结束的span交给exporter
+ */
+type Tracer struct {
+	exporter Exporter // 为nil时不导出，仅生成id用于传递
+}
+
+// 默认不导出，New之后按配置导出
+var std = &Tracer{}
+
+/*New
+ * @Description: 按配置创建tracer，Setting.TracePath为空时不导出span
+ * @return t
+ * @return cf 关闭导出文件
+ * @return err
+ */
+func New() (t *Tracer, cf func(), err error) {
+	config.GetConfigure()
+	cf = func() {}
+	if path := config.Setting().TracePath; path != "" {
+		exp, err := NewFileExporter(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		std.exporter = exp
+		cf = func() {
+			_ = exp.Close()
+		}
+	}
+	return std, cf, nil
+}
+
+type spanKey struct{}
+
+// ContextWithSpan 将span放入ctx
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext 获取ctx中的span，没有时返回nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+/**
+ * @Description: 开始一个span，remote有效时作为其子span（同一trace），否则开始新的trace
+ * @receiver t
+ * @param ctx
+ * @param name
+ * @param remote 上游传入的span信息
+ * @return context.Context 带有新span的ctx
+ * @return *Span
+ */
+func (t *Tracer) Start(ctx context.Context, name string, remote SpanContext) (context.Context, *Span) {
+	s := &Span{tracer: t, name: name, start: time.Now(), attrs: make(map[string]interface{})}
+	if remote.IsValid() {
+		s.sc.TraceID, s.parent, s.sc.Sampled = remote.TraceID, remote.SpanID, remote.Sampled
+	} else {
+		_, _ = rand.Read(s.sc.TraceID[:])
+		s.sc.Sampled = true
+	}
+	_, _ = rand.Read(s.sc.SpanID[:])
+	return ContextWithSpan(ctx, s), s
+}
+
+/**
+ * @Description: 以默认tracer开始新的trace，用于定时任务等没有上游请求的场景
+ * @param ctx
+ * @param name
+ * @return context.Context
+ * @return *Span
+ */
+func Root(ctx context.Context, name string) (context.Context, *Span) {
+	return std.Start(ctx, name, SpanContext{})
+}
+
+/**
+ * @Description: 开始ctx中span的子span，ctx中没有span时不追踪，返回nil span
+ * @param ctx
+ * @param name
+ * @return context.Context
+ * @return *Span
+ */
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, parent.sc)
+}
@@ -0,0 +1,68 @@
+package trace
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type memExporter struct {
+	mu    sync.Mutex
+	spans []*SpanData
+}
+
+func (m *memExporter) Export(s *SpanData) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, s)
+}
+
+func TestParseTraceparent(t *testing.T) {
+	h := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	sc, err := ParseTraceparent(h)
+	assert.Nil(t, err)
+	assert.True(t, sc.Sampled)
+	assert.Equal(t, h, sc.Traceparent())
+
+	for _, bad := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01",
+	} {
+		_, err = ParseTraceparent(bad)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	exp := new(memExporter)
+	tr := &Tracer{exporter: exp}
+	remote, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx, root := tr.Start(context.Background(), "GET /query", remote)
+	_, child := Start(ctx, "StartHandle")
+	child.SetAttr("handles", 2)
+	child.SetError(errors.New("bad sql"))
+	child.End()
+	root.End()
+	root.End()
+
+	assert.Equal(t, 2, len(exp.spans))
+	c, r := exp.spans[0], exp.spans[1]
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", r.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", r.ParentSpanID)
+	assert.Equal(t, r.TraceID, c.TraceID)
+	assert.Equal(t, r.SpanID, c.ParentSpanID)
+	assert.Equal(t, StatusError, c.Status)
+	assert.Equal(t, 2, c.Attributes["handles"])
+
+	// ctx中没有span时不追踪
+	_, none := Start(context.Background(), "noop")
+	assert.Nil(t, none)
+	none.SetAttr("k", "v")
+	none.End()
+}
@@ -0,0 +1,102 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// thrift compact protocol 中的类型
+const (
+	tI32    = 5
+	tI64    = 6
+	tBinary = 8
+	tList   = 9
+	tStruct = 12
+)
+
+/*
+ * thriftWriter 以thrift compact protocol编码parquet的元数据（仅实现写入所需的部分
+ */
+type thriftWriter struct {
+	buf    bytes.Buffer
+	lastID int16   // 当前结构体中上一个字段id
+	stack  []int16 // 嵌套结构体的lastID
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	t.buf.Write(b[:n])
+}
+
+func (t *thriftWriter) zigzag(v int64) {
+	t.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	delta := id - t.lastID
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.zigzag(int64(id))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, tI32)
+	t.zigzag(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, tI64)
+	t.zigzag(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.field(id, tBinary)
+	t.varint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
+
+// listHeader 写入列表字段头，之后需按元素类型依次写入size个元素
+func (t *thriftWriter) listHeader(id int16, elemType byte, size int) {
+	t.field(id, tList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xF0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) i32List(id int16, vs []int32) {
+	t.listHeader(id, tI32, len(vs))
+	for _, v := range vs {
+		t.zigzag(int64(v))
+	}
+}
+
+func (t *thriftWriter) binaryList(id int16, vs []string) {
+	t.listHeader(id, tBinary, len(vs))
+	for _, v := range vs {
+		t.varint(uint64(len(v)))
+		t.buf.WriteString(v)
+	}
+}
+
+// structBegin 开始写入结构体，id为0时为列表元素或顶层结构体，不写字段头
+func (t *thriftWriter) structBegin(id int16) {
+	if id != 0 {
+		t.field(id, tStruct)
+	}
+	t.stack = append(t.stack, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) structEnd() {
+	t.buf.WriteByte(0) // stop
+	t.lastID = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
@@ -0,0 +1,341 @@
+// Package parquet 实现只写的parquet文件输出
+// 所有列均为可空（OPTIONAL）的基本类型，PLAIN编码、不压缩，每个行组的每个列块一个数据页
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Type 列类型，取值与parquet物理类型一致
+type Type int32
+
+const (
+	Int32  Type = 1 // INT32
+	Int64  Type = 2 // INT64
+	Double Type = 5 // DOUBLE
+	String Type = 6 // BYTE_ARRAY，逻辑类型UTF8
+)
+
+// parquet元数据中的枚举值
+const (
+	repetitionOptional = 1
+	convertedUTF8      = 0
+	encodingPlain      = 0
+	encodingRLE        = 3
+	codecUncompressed  = 0
+	pageTypeData       = 0
+)
+
+const (
+	magic = "PAR1"
+	// DefaultRowGroupSize 默认每个行组的行数
+	DefaultRowGroupSize = 65536
+)
+
+// Column 列定义
+type Column struct {
+	Name string
+	Type Type
+}
+
+type column struct {
+	Column
+	defs   []byte       // 每行的定义级别，1为有值，0为空
+	values bytes.Buffer // PLAIN编码后的非空值
+}
+
+type chunkMeta struct {
+	offset    int64 // 数据页在文件中的位置
+	size      int64 // 页头加数据页的大小
+	numValues int64
+}
+
+type rowGroup struct {
+	chunks []chunkMeta
+	size   int64
+	rows   int64
+}
+
+// Writer parquet写入，数据按行写入，每满RowGroupSize行写出一个行组，Close时写入文件尾
+type Writer struct {
+	RowGroupSize int
+
+	w         io.Writer
+	offset    int64
+	cols      []*column
+	rows      int // 当前行组中的行数
+	rowGroups []rowGroup
+	conv      []interface{}
+}
+
+// NewWriter 创建parquet写入对象并写入文件头
+func NewWriter(w io.Writer, cols []Column) (*Writer, error) {
+	pw := &Writer{RowGroupSize: DefaultRowGroupSize, w: w, conv: make([]interface{}, len(cols))}
+	for _, c := range cols {
+		switch c.Type {
+		case Int32, Int64, Double, String:
+		default:
+			return nil, fmt.Errorf("parquet: column %s has unsupported type %d", c.Name, c.Type)
+		}
+		pw.cols = append(pw.cols, &column{Column: c})
+	}
+	return pw, pw.write([]byte(magic))
+}
+
+// Write 写入一行，row中的值与列一一对应，nil为空值
+// Int32/Int64 接受整数类型，Double 接受浮点及整数类型，String 接受string及[]byte
+func (w *Writer) Write(row []interface{}) error {
+	if len(row) != len(w.cols) {
+		return fmt.Errorf("parquet: row has %d values, want %d", len(row), len(w.cols))
+	}
+	// 先全部转换，避免某列出错时各列行数不一致
+	for i, c := range w.cols {
+		v, err := c.convert(row[i])
+		if err != nil {
+			return err
+		}
+		w.conv[i] = v
+	}
+	for i, c := range w.cols {
+		c.put(w.conv[i])
+	}
+	w.rows++
+	if w.RowGroupSize > 0 && w.rows >= w.RowGroupSize {
+		return w.flushRowGroup()
+	}
+	return nil
+}
+
+// Close 写出剩余数据及文件尾，不关闭底层io.Writer
+func (w *Writer) Close() error {
+	if w.rows > 0 {
+		if err := w.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+	meta := w.fileMetaData()
+	if err := w.write(meta); err != nil {
+		return err
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(meta)))
+	if err := w.write(size[:]); err != nil {
+		return err
+	}
+	return w.write([]byte(magic))
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	return err
+}
+
+func (c *column) convert(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch c.Type {
+	case Int32:
+		n, ok := toInt64(v)
+		if !ok || n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, fmt.Errorf("parquet: column %s: %v is not an int32", c.Name, v)
+		}
+		return int32(n), nil
+	case Int64:
+		n, ok := toInt64(v)
+		if !ok {
+			return nil, fmt.Errorf("parquet: column %s: %v is not an int64", c.Name, v)
+		}
+		return n, nil
+	case Double:
+		switch f := v.(type) {
+		case float64:
+			return f, nil
+		case float32:
+			return float64(f), nil
+		}
+		n, ok := toInt64(v)
+		if !ok {
+			return nil, fmt.Errorf("parquet: column %s: %v is not a double", c.Name, v)
+		}
+		return float64(n), nil
+	default:
+		switch s := v.(type) {
+		case string:
+			return s, nil
+		case []byte:
+			return string(s), nil
+		}
+		return nil, fmt.Errorf("parquet: column %s: %v is not a string", c.Name, v)
+	}
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	}
+	return 0, false
+}
+
+// put 追加已转换的值
+func (c *column) put(v interface{}) {
+	if v == nil {
+		c.defs = append(c.defs, 0)
+		return
+	}
+	c.defs = append(c.defs, 1)
+	var b [8]byte
+	switch value := v.(type) {
+	case int32:
+		binary.LittleEndian.PutUint32(b[:4], uint32(value))
+		c.values.Write(b[:4])
+	case int64:
+		binary.LittleEndian.PutUint64(b[:], uint64(value))
+		c.values.Write(b[:])
+	case float64:
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		c.values.Write(b[:])
+	case string:
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(value)))
+		c.values.Write(b[:4])
+		c.values.WriteString(value)
+	}
+}
+
+// flushRowGroup 将当前行组的每一列写为一个数据页
+func (w *Writer) flushRowGroup() error {
+	rg := rowGroup{rows: int64(w.rows)}
+	for _, c := range w.cols {
+		page := c.page()
+		header := pageHeader(len(page), w.rows)
+		chunk := chunkMeta{offset: w.offset, size: int64(len(header) + len(page)), numValues: int64(w.rows)}
+		if err := w.write(header); err != nil {
+			return err
+		}
+		if err := w.write(page); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+		rg.size += chunk.size
+		c.defs = c.defs[:0]
+		c.values.Reset()
+	}
+	w.rowGroups = append(w.rowGroups, rg)
+	w.rows = 0
+	return nil
+}
+
+// page 数据页内容：4字节长度加RLE编码的定义级别，之后为PLAIN编码的非空值
+func (c *column) page() []byte {
+	levels := rleLevels(c.defs)
+	page := make([]byte, 4, 4+len(levels)+c.values.Len())
+	binary.LittleEndian.PutUint32(page, uint32(len(levels)))
+	page = append(page, levels...)
+	return append(page, c.values.Bytes()...)
+}
+
+// rleLevels 以RLE/bit-packing混合编码中的RLE游程编码位宽为1的定义级别
+func rleLevels(defs []byte) []byte {
+	var out []byte
+	var b [binary.MaxVarintLen64]byte
+	for i := 0; i < len(defs); {
+		j := i
+		for j < len(defs) && defs[j] == defs[i] {
+			j++
+		}
+		n := binary.PutUvarint(b[:], uint64(j-i)<<1)
+		out = append(out, b[:n]...)
+		out = append(out, defs[i])
+		i = j
+	}
+	return out
+}
+
+func pageHeader(size int, numValues int) []byte {
+	t := new(thriftWriter)
+	t.structBegin(0)
+	t.i32(1, pageTypeData)
+	t.i32(2, int32(size))
+	t.i32(3, int32(size))
+	t.structBegin(5) // data_page_header
+	t.i32(1, int32(numValues))
+	t.i32(2, encodingPlain)
+	t.i32(3, encodingRLE)
+	t.i32(4, encodingRLE)
+	t.structEnd()
+	t.structEnd()
+	return t.buf.Bytes()
+}
+
+func (w *Writer) fileMetaData() []byte {
+	var numRows int64
+	for _, rg := range w.rowGroups {
+		numRows += rg.rows
+	}
+	t := new(thriftWriter)
+	t.structBegin(0)
+	t.i32(1, 1) // version
+	t.listHeader(2, tStruct, len(w.cols)+1)
+	t.structBegin(0) // 根节点
+	t.binary(4, "schema")
+	t.i32(5, int32(len(w.cols)))
+	t.structEnd()
+	for _, c := range w.cols {
+		t.structBegin(0)
+		t.i32(1, int32(c.Type))
+		t.i32(3, repetitionOptional)
+		t.binary(4, c.Name)
+		if c.Type == String {
+			t.i32(6, convertedUTF8)
+		}
+		t.structEnd()
+	}
+	t.i64(3, numRows)
+	t.listHeader(4, tStruct, len(w.rowGroups))
+	for _, rg := range w.rowGroups {
+		t.structBegin(0)
+		t.listHeader(1, tStruct, len(rg.chunks))
+		for i, chunk := range rg.chunks {
+			c := w.cols[i]
+			t.structBegin(0)
+			t.i64(2, chunk.offset)
+			t.structBegin(3) // meta_data
+			t.i32(1, int32(c.Type))
+			t.i32List(2, []int32{encodingPlain, encodingRLE})
+			t.binaryList(3, []string{c.Name})
+			t.i32(4, codecUncompressed)
+			t.i64(5, chunk.numValues)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, rg.size)
+		t.i64(3, rg.rows)
+		t.structEnd()
+	}
+	t.binary(6, "pg-adapter")
+	t.structEnd()
+	return t.buf.Bytes()
+}
@@ -0,0 +1,211 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, []Column{{"code", String}, {"datetime", Int32}, {"value", Double}})
+	assert.Nil(t, err)
+	w.RowGroupSize = 2
+	assert.Nil(t, w.Write([]interface{}{"300033", 20210803, 1.5}))
+	assert.Nil(t, w.Write([]interface{}{"300093", 20210803, nil}))
+	assert.Nil(t, w.Write([]interface{}{nil, int64(20210804), 2}))
+	assert.Nil(t, w.Close())
+	assert.Len(t, w.rowGroups, 2)
+
+	data := buf.Bytes()
+	assert.Equal(t, magic, string(data[:4]))
+	assert.Equal(t, magic, string(data[len(data)-4:]))
+	metaLen := binary.LittleEndian.Uint32(data[len(data)-8:])
+	assert.Less(t, int(metaLen), len(data)-12)
+}
+
+// TestWriterRoundTrip 按文件尾的元数据读回每个列块，校验schema、行组及每行的值
+func TestWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []Column{{"code", String}, {"datetime", Int32}, {"volume", Int64}, {"value", Double}}
+	rows := [][]interface{}{
+		{"300033", int32(20210803), int64(100), 1.5},
+		{"300093", int32(20210803), nil, nil},
+		{nil, int32(20210804), int64(-7), 2.25},
+	}
+	w, err := NewWriter(&buf, cols)
+	assert.Nil(t, err)
+	w.RowGroupSize = 2
+	for _, row := range rows {
+		assert.Nil(t, w.Write(row))
+	}
+	assert.Nil(t, w.Close())
+
+	data := buf.Bytes()
+	metaLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	r := &thriftReader{data: data[len(data)-8-metaLen : len(data)-8]}
+	meta := r.readStruct()
+	assert.Equal(t, metaLen, r.pos)
+	assert.Equal(t, int64(1), meta[1])
+	assert.Equal(t, int64(len(rows)), meta[3])
+
+	schema := meta[2].([]interface{})
+	assert.Len(t, schema, len(cols)+1)
+	assert.Equal(t, int64(len(cols)), schema[0].(map[int16]interface{})[5])
+	for i, c := range cols {
+		elem := schema[i+1].(map[int16]interface{})
+		assert.Equal(t, c.Name, elem[4])
+		assert.Equal(t, int64(c.Type), elem[1])
+		assert.Equal(t, int64(repetitionOptional), elem[3])
+	}
+
+	got := make([][]interface{}, 0, len(rows))
+	for _, g := range meta[4].([]interface{}) {
+		rg := g.(map[int16]interface{})
+		n := int(rg[3].(int64))
+		groupRows := make([][]interface{}, n)
+		for i := range groupRows {
+			groupRows[i] = make([]interface{}, len(cols))
+		}
+		chunks := rg[1].([]interface{})
+		assert.Len(t, chunks, len(cols))
+		for i, ch := range chunks {
+			cm := ch.(map[int16]interface{})[3].(map[int16]interface{})
+			assert.Equal(t, int64(cols[i].Type), cm[1])
+			assert.Equal(t, []interface{}{cols[i].Name}, cm[3])
+			assert.Equal(t, int64(n), cm[5])
+			values := readPage(t, data, cm[9].(int64), cols[i].Type, n)
+			for j, v := range values {
+				groupRows[j][i] = v
+			}
+		}
+		got = append(got, groupRows...)
+	}
+	assert.Equal(t, rows, got)
+}
+
+// readPage 读取offset处的数据页，返回每行的值，空值为nil
+func readPage(t *testing.T, data []byte, offset int64, typ Type, n int) []interface{} {
+	r := &thriftReader{data: data[offset:]}
+	header := r.readStruct()
+	assert.Equal(t, int64(pageTypeData), header[1])
+	assert.Equal(t, int64(n), header[5].(map[int16]interface{})[1])
+	page := data[offset+int64(r.pos) : offset+int64(r.pos)+header[3].(int64)]
+
+	levelLen := int(binary.LittleEndian.Uint32(page))
+	levels := page[4 : 4+levelLen]
+	defs := make([]byte, 0, n)
+	for p := 0; p < len(levels); {
+		run, k := binary.Uvarint(levels[p:])
+		assert.Equal(t, uint64(0), run&1, "bit-packed runs are not expected")
+		for i := uint64(0); i < run>>1; i++ {
+			defs = append(defs, levels[p+k])
+		}
+		p += k + 1
+	}
+	assert.Len(t, defs, n)
+
+	plain := page[4+levelLen:]
+	values := make([]interface{}, n)
+	for i, def := range defs {
+		if def == 0 {
+			continue
+		}
+		switch typ {
+		case Int32:
+			values[i] = int32(binary.LittleEndian.Uint32(plain))
+			plain = plain[4:]
+		case Int64:
+			values[i] = int64(binary.LittleEndian.Uint64(plain))
+			plain = plain[8:]
+		case Double:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(plain))
+			plain = plain[8:]
+		case String:
+			size := int(binary.LittleEndian.Uint32(plain))
+			values[i] = string(plain[4 : 4+size])
+			plain = plain[4+size:]
+		}
+	}
+	assert.Len(t, plain, 0)
+	return values
+}
+
+// thriftReader 解码thrift compact protocol，仅支持writer用到的类型，结构体解码为 字段id=>值
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) varint() uint64 {
+	v, n := binary.Uvarint(r.data[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := make(map[int16]interface{})
+	var lastID int16
+	for {
+		b := r.data[r.pos]
+		r.pos++
+		if b == 0 {
+			return fields
+		}
+		id := lastID + int16(b>>4)
+		if b>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		fields[id] = r.readValue(b & 0x0F)
+		lastID = id
+	}
+}
+
+func (r *thriftReader) readValue(typ byte) interface{} {
+	switch typ {
+	case tI32, tI64:
+		return r.zigzag()
+	case tBinary:
+		size := int(r.varint())
+		s := string(r.data[r.pos : r.pos+size])
+		r.pos += size
+		return s
+	case tList:
+		b := r.data[r.pos]
+		r.pos++
+		size := int(b >> 4)
+		if size == 15 {
+			size = int(r.varint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.readValue(b & 0x0F)
+		}
+		return list
+	case tStruct:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("unsupported thrift type %d", typ))
+}
+
+func TestWriterTypeMismatch(t *testing.T) {
+	w, err := NewWriter(new(bytes.Buffer), []Column{{"code", String}, {"datetime", Int32}})
+	assert.Nil(t, err)
+	assert.NotNil(t, w.Write([]interface{}{"300033", "20210803"}))
+	assert.NotNil(t, w.Write([]interface{}{"300033"}))
+	// 出错的行不写入任何一列
+	assert.Len(t, w.cols[0].defs, 0)
+}
+
+func TestRLELevels(t *testing.T) {
+	assert.Equal(t, []byte{6, 1, 2, 0}, rleLevels([]byte{1, 1, 1, 0}))
+}